@@ -3,6 +3,7 @@ package certificates
 import (
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os/exec"
 	"path"
 	"strings"
@@ -130,6 +131,22 @@ type CertConfig struct {
 	ExtraOpts map[string]string
 
 	JSONOverride []byte
+
+	// Logger, if set, receives the output of cfssl and cfssljson instead
+	// of stdout
+	Logger *log.Logger
+}
+
+// print writes the output of a cfssl command to conf.Logger or stdout.
+func (conf CertConfig) print(out []byte) {
+	if len(out) == 0 {
+		return
+	}
+	if conf.Logger != nil {
+		conf.Logger.Print(string(out))
+		return
+	}
+	fmt.Println(string(out))
 }
 
 func CreateCert(conf CertConfig) error {
@@ -184,9 +201,7 @@ func CreateCert(conf CertConfig) error {
 
 	out, err := cfsslCmd.CombinedOutput()
 	if err != nil {
-		if string(out) != "" {
-			fmt.Println(string(out))
-		}
+		conf.print(out)
 		return errors.Wrap(err, "cfssl error generating cert")
 	}
 
@@ -207,9 +222,7 @@ func CreateCert(conf CertConfig) error {
 	err = jsonPipe.Close()
 
 	out, err = cfssljsonCmd.CombinedOutput()
-	if string(out) != "" {
-		fmt.Println(string(out))
-	}
+	conf.print(out)
 	if err != nil {
 		return err
 	}
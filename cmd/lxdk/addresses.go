@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log"
+	"net"
+
+	"github.com/greymatter-io/lxdk/config"
+	"github.com/greymatter-io/lxdk/containers"
+	lxdclient "github.com/lxc/lxd/client"
+)
+
+// allocateAddresses picks a static address on the network of state for each
+// of nodes, keyed by node. Certificates and kubeconfigs embed the addresses
+// of nodes, so they must not change when DHCP leases do. If the network
+// can't give static addresses no node gets one, and they keep using DHCP.
+func allocateAddresses(state config.ClusterState, nodes []string, is lxdclient.InstanceServer) (map[string]string, error) {
+	addresses := make(map[string]string)
+
+	subnet, used, err := containers.NetworkAddresses(state.NetworkID, is)
+	if err != nil {
+		return nil, err
+	}
+	if subnet == nil {
+		log.Default().Printf("network %s can't give nodes static addresses, they will use DHCP", state.NetworkID)
+		return addresses, nil
+	}
+
+	// nodes that are stopped have no lease to show their address is taken
+	for _, node := range state.Nodes {
+		if ip := net.ParseIP(node.StaticIP); ip != nil {
+			used = append(used, ip)
+		}
+	}
+
+	ips, err := containers.AllocateAddresses(subnet, used, len(nodes))
+	if err != nil {
+		return nil, err
+	}
+	for i, node := range nodes {
+		addresses[node] = ips[i].String()
+	}
+
+	return addresses, nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	certs "github.com/greymatter-io/lxdk/certificates"
+	"github.com/greymatter-io/lxdk/config"
+	"github.com/greymatter-io/lxdk/containers"
+	"github.com/greymatter-io/lxdk/lxd"
+	lxdclient "github.com/lxc/lxd/client"
+	"github.com/lxc/lxd/shared/api"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// adoptCmd rebuilds the cache directory of a cluster whose LXD resources
+// still exist, using the user.lxdk.* keys set on them at create time.
+var adoptCmd = &cli.Command{
+	Name:   "adopt",
+	Usage:  "rebuild the state of a cluster from its LXD resources",
+	Flags:  remoteFlags,
+	Action: doAdopt,
+}
+
+func doAdopt(ctx *cli.Context) error {
+	cacheDir := ctx.String("cache")
+
+	clusterName := ctx.Args().First()
+	if clusterName == "" {
+		return errors.New("must supply cluster name")
+	}
+	clusterDir := path.Join(cacheDir, clusterName)
+
+	if _, err := os.Stat(path.Join(clusterDir, "state.toml")); err == nil {
+		return errors.Errorf("cluster %s already has state at %s", clusterName, clusterDir)
+	}
+
+	is, hostname, err := connectFlags(ctx)
+	if err != nil {
+		return err
+	}
+
+	state, err := adoptState(clusterName, is)
+	if err != nil {
+		return err
+	}
+	state.Remote = ctx.String("remote")
+	if state.Remote == "" {
+		state.Remote, err = lxd.DefaultRemote(lxdConfigPath(ctx))
+		if err != nil {
+			return err
+		}
+	}
+	state.Project = ctx.String("project")
+
+	// a cluster can't be told apart from one that was never started, so
+	// assume it was; start reprovisions either way
+	state.RunState = config.Stopped
+	status, err := reconcileState(&state, is)
+	if err != nil {
+		return err
+	}
+
+	for i, node := range state.Nodes {
+		if !status.isRunning(node.Name) {
+			continue
+		}
+		ip, err := containers.GetContainerLXDIP(node.Name, []string{hostname}, is)
+		if err != nil {
+			log.Default().Printf("could not get address of %s: %s", node.Name, err)
+			continue
+		}
+		state.Nodes[i].IP = ip.String()
+	}
+
+	if err := config.SaveClusterState(cacheDir, state); err != nil {
+		return err
+	}
+	log.Default().Printf("adopted cluster %s with %d nodes", clusterName, len(state.Nodes))
+
+	if err := recoverCerts(state, clusterDir, is); err != nil {
+		log.Default().Printf("could not recover certificates, the cluster will need new ones: %s", err)
+		return nil
+	}
+
+	controller, _ := state.Node(state.ControllerContainerName)
+	if controller.IP != "" {
+		if err := createAdminKubeconfig(clusterDir, controller.IP); err != nil {
+			return err
+		}
+		if err := createClientKubeconfig(clusterDir, clientServer(state, controller.IP, "", false)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// adoptState builds the state of clusterName from the LXD instances, network
+// and storage pool tagged as belonging to it.
+func adoptState(clusterName string, is lxdclient.InstanceServer) (config.ClusterState, error) {
+	state := config.ClusterState{Name: clusterName}
+
+	instances, err := is.GetInstances(api.InstanceTypeAny)
+	if err != nil {
+		return state, err
+	}
+
+	var owned []api.Instance
+	for _, in := range instances {
+		if in.Config[containers.MetadataCluster] == clusterName {
+			owned = append(owned, in)
+		}
+	}
+	if len(owned) == 0 {
+		return state, errors.Errorf("no LXD instances are tagged as belonging to cluster %s", clusterName)
+	}
+
+	// workers are numbered in creation order
+	sort.Slice(owned, func(i, j int) bool {
+		return owned[i].CreatedAt.Before(owned[j].CreatedAt)
+	})
+
+	for _, in := range owned {
+		role := in.Config[containers.MetadataRole]
+		switch role {
+		case config.RoleEtcd:
+			state.EtcdContainerName = in.Name
+		case config.RoleController:
+			state.ControllerContainerName = in.Name
+		case config.RoleRegistry:
+			state.RegistryContainerName = in.Name
+		case config.RoleWorker:
+			state.WorkerContainerNames = append(state.WorkerContainerNames, in.Name)
+		default:
+			log.Default().Printf("instance %s has unknown role %q", in.Name, role)
+		}
+
+		state.Containers = append(state.Containers, in.Name)
+		state.SetNode(config.Node{
+			Name:             in.Name,
+			Role:             role,
+			MAC:              in.Config["volatile.eth0.hwaddr"],
+			ImageAlias:       containers.ImageAlias(role),
+			ImageFingerprint: in.Config["volatile.base_image"],
+		})
+
+		if state.CreatedAt.IsZero() {
+			state.CreatedAt = in.CreatedAt.UTC()
+			state.LXDKVersion = in.Config[containers.MetadataVersion]
+		}
+		if state.StoragePool == "" {
+			state.StoragePool = in.Devices["root"]["pool"]
+		}
+		if state.NetworkID == "" {
+			state.NetworkID = in.Devices["eth0"]["network"]
+			if state.NetworkID == "" {
+				state.NetworkID = in.Devices["eth0"]["parent"]
+			}
+		}
+	}
+
+	for role, name := range map[string]string{
+		config.RoleEtcd:       state.EtcdContainerName,
+		config.RoleController: state.ControllerContainerName,
+		config.RoleRegistry:   state.RegistryContainerName,
+	} {
+		if name == "" {
+			log.Default().Printf("cluster %s has no %s node", clusterName, role)
+		}
+	}
+
+	if state.StoragePool != "" {
+		pool, _, err := is.GetStoragePool(state.StoragePool)
+		if err != nil {
+			return state, err
+		}
+		state.StorageDriver = pool.Driver
+	}
+
+	return state, nil
+}
+
+// recoverCerts copies the certificates and kubeconfigs pushed to the nodes at
+// start back into clusterDir, and reissues the admin cert, which is never
+// pushed, from the recovered CA. The etcd and aggregation CA keys are not
+// kept on any node and can't be recovered.
+func recoverCerts(state config.ClusterState, clusterDir string, is lxdclient.InstanceServer) error {
+	if state.ControllerContainerName == "" {
+		return errors.New("cluster has no controller to recover certificates from")
+	}
+
+	certDir := path.Join(clusterDir, "certificates")
+	kfgDir := path.Join(clusterDir, "kubeconfigs")
+	for _, dir := range []string{certDir, kfgDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("could not mkdir %s: %w", dir, err)
+		}
+	}
+
+	files := map[string][]string{
+		state.ControllerContainerName: {
+			"kubernetes.pem",
+			"kubernetes-key.pem",
+			"ca.pem",
+			"ca-key.pem",
+			"etcd.pem",
+			"etcd-key.pem",
+			"ca-etcd.pem",
+			"ca-aggregation.pem",
+			"aggregation-client.pem",
+			"aggregation-client-key.pem",
+			"kube-controller-manager.kubeconfig",
+			"kube-scheduler.kubeconfig",
+			"kube-proxy.kubeconfig",
+		},
+	}
+	for _, worker := range append(state.WorkerContainerNames, state.ControllerContainerName) {
+		lowerName := strings.ToLower(worker)
+		files[worker] = append(files[worker],
+			lowerName+".pem",
+			lowerName+"-key.pem",
+			lowerName+"-kubelet.kubeconfig",
+		)
+	}
+
+	for container, names := range files {
+		for _, name := range names {
+			data, err := containers.DownloadFile(container, path.Join("/etc/kubernetes", name), is)
+			if err != nil {
+				log.Default().Printf("could not recover %s: %s", name, err)
+				continue
+			}
+
+			dir := certDir
+			if strings.HasSuffix(name, ".kubeconfig") {
+				dir = kfgDir
+			}
+			if err := ioutil.WriteFile(path.Join(dir, name), data, 0600); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := os.Stat(path.Join(certDir, "ca-key.pem")); err != nil {
+		return errors.New("the Kubernetes CA key could not be recovered")
+	}
+
+	caConfigPath, err := certs.WriteCAConfig(certDir)
+	if err != nil {
+		return err
+	}
+
+	return createAdminCert(certDir, caConfigPath)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// compression returns how an archive is compressed from its file name:
+// "zstd" for .zst and .tzst, "gzip" for .gz and .tgz, or "" for none.
+func compression(filename string) string {
+	switch {
+	case strings.HasSuffix(filename, ".zst"), strings.HasSuffix(filename, ".tzst"):
+		return "zstd"
+	case strings.HasSuffix(filename, ".gz"), strings.HasSuffix(filename, ".tgz"):
+		return "gzip"
+	}
+
+	return ""
+}
+
+// createArchive creates filename and returns a writer that compresses what is
+// written to it as the file name asks for. zstd compression needs the zstd
+// binary.
+func createArchive(filename string) (io.WriteCloser, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	switch compression(filename) {
+	case "zstd":
+		cmd := exec.Command("zstd", "-q", "-c", "-T0")
+		cmd.Stdout = f
+		cmd.Stderr = os.Stderr
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("could not run zstd, is it installed? %w", err)
+		}
+		return &cmdWriter{WriteCloser: stdin, cmd: cmd, f: f}, nil
+	case "gzip":
+		return &gzipWriter{Writer: gzip.NewWriter(f), f: f}, nil
+	}
+
+	return f, nil
+}
+
+// openArchive opens filename and returns a reader that decompresses it as the
+// file name says it is compressed.
+func openArchive(filename string) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	switch compression(filename) {
+	case "zstd":
+		cmd := exec.Command("zstd", "-q", "-d", "-c")
+		cmd.Stdin = f
+		cmd.Stderr = os.Stderr
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("could not run zstd, is it installed? %w", err)
+		}
+		return &cmdReader{ReadCloser: stdout, cmd: cmd, f: f}, nil
+	case "gzip":
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &gzipReader{Reader: gz, f: f}, nil
+	}
+
+	return f, nil
+}
+
+type cmdWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+	f   *os.File
+}
+
+func (w *cmdWriter) Close() error {
+	w.WriteCloser.Close()
+	err := w.cmd.Wait()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+type cmdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+	f   *os.File
+}
+
+func (r *cmdReader) Close() error {
+	// the archive may not have been read to the end
+	io.Copy(io.Discard, r.ReadCloser)
+	err := r.cmd.Wait()
+	r.f.Close()
+
+	return err
+}
+
+type gzipWriter struct {
+	*gzip.Writer
+	f *os.File
+}
+
+func (w *gzipWriter) Close() error {
+	err := w.Writer.Close()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+type gzipReader struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (r *gzipReader) Close() error {
+	r.Reader.Close()
+	return r.f.Close()
+}
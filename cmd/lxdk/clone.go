@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/greymatter-io/lxdk/config"
+	"github.com/greymatter-io/lxdk/containers"
+	"github.com/greymatter-io/lxdk/kubernetes"
+	"github.com/greymatter-io/lxdk/version"
+	lxdclient "github.com/lxc/lxd/client"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// cloneCmd copies a cluster onto a new network and storage pool and starts
+// the copy, which is much faster than creating and provisioning a cluster
+// from scratch.
+var cloneCmd = &cli.Command{
+	Name:      "clone",
+	Usage:     "copy a cluster, or one of its snapshots, into a new cluster",
+	ArgsUsage: "<source cluster> <new cluster>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "snapshot",
+			Usage: "cluster snapshot to copy instead of the current state of the source",
+		},
+		&cli.StringFlag{
+			Name:  "storage-pool",
+			Usage: "lxd storage pool use, overrides storage pool creation",
+		},
+		&cli.StringFlag{
+			Name:  "network",
+			Usage: "network id of lxd network to use, overrides network creation",
+		},
+	},
+	Action: doClone,
+}
+
+func doClone(ctx *cli.Context) error {
+	cacheDir := ctx.String("cache")
+
+	if ctx.Args().Len() != 2 {
+		return errors.New("must supply source and new cluster names")
+	}
+	srcName, dstName := ctx.Args().Get(0), ctx.Args().Get(1)
+
+	if _, err := os.Stat(path.Join(cacheDir, dstName)); err == nil {
+		return errors.Errorf("cluster %s already exists at path %s", dstName, path.Join(cacheDir, dstName))
+	}
+
+	src, err := config.LoadClusterState(cacheDir, srcName)
+	if err != nil {
+		return err
+	}
+	src.Name = srcName
+
+	is, _, err := connectCluster(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	parallelism := ctx.Int("parallelism")
+
+	// copying a running container doesn't give a consistent copy, so copy
+	// from a snapshot, taking a temporary one if none was given
+	snapshot := ctx.String("snapshot")
+	if snapshot != "" {
+		if _, ok := src.Snapshot(snapshot); !ok {
+			return errors.Errorf("cluster %s has no snapshot named %s", srcName, snapshot)
+		}
+	} else {
+		status, err := reconcileState(&src, is)
+		if err != nil {
+			return err
+		}
+		if len(status.Missing) > 0 {
+			return errors.Errorf("cluster %s is missing nodes %s and cannot be cloned", srcName, strings.Join(status.Missing, ", "))
+		}
+
+		snapshot = time.Now().UTC().Format("lxdk-clone-20060102-150405")
+		if err := snapshotCluster(src, snapshot, status.isRunning(src.EtcdContainerName), parallelism, is); err != nil {
+			return err
+		}
+		defer func() {
+			err := forEachNode(src.Containers, parallelism, func(container string) error {
+				return containers.DeleteSnapshot(container, snapshot, is)
+			})
+			if err != nil {
+				log.Default().Printf("could not delete temporary snapshot %s: %s", snapshot, err)
+			}
+		}()
+	}
+
+	dst := config.ClusterState{
+		Name:              dstName,
+		NetworkID:         ctx.String("network"),
+		Remote:            src.Remote,
+		Project:           src.Project,
+		RunState:          config.Uninitialized,
+		StorageDriver:     src.StorageDriver,
+		StoragePool:       ctx.String("storage-pool"),
+		CgroupMode:        src.CgroupMode,
+		Profile:           src.Profile,
+		Unprivileged:      src.Unprivileged,
+		Images:            src.Images,
+		KubernetesVersion: src.KubernetesVersion,
+		LXDKVersion:       version.Version(),
+		CreateFlags:       src.CreateFlags,
+		Mounts:            src.Mounts,
+	}
+	if dst.StorageDriver == "" {
+		dst.StorageDriver = "btrfs"
+	}
+
+	rollback, err := createNetworkAndPool(&dst, is)
+	if err != nil {
+		return err
+	}
+
+	addresses, err := allocateAddresses(dst, src.Containers, is)
+	if err != nil {
+		rollback()
+		return err
+	}
+
+	names, err := cloneContainers(src, dst, snapshot, addresses, parallelism, is)
+	if err != nil {
+		rollback()
+		return err
+	}
+
+	for _, oldName := range src.Containers {
+		node, _ := src.Node(oldName)
+		name := names[oldName]
+
+		switch node.Role {
+		case config.RoleEtcd:
+			dst.EtcdContainerName = name
+		case config.RoleController:
+			dst.ControllerContainerName = name
+		case config.RoleRegistry:
+			dst.RegistryContainerName = name
+		case config.RoleWorker:
+			dst.WorkerContainerNames = append(dst.WorkerContainerNames, name)
+		}
+
+		dst.Containers = append(dst.Containers, name)
+		dst.SetNode(config.Node{
+			Name:             name,
+			Role:             node.Role,
+			StaticIP:         addresses[oldName],
+			ImageAlias:       node.ImageAlias,
+			ImageFingerprint: node.ImageFingerprint,
+		})
+	}
+	dst.CreatedAt = time.Now().UTC()
+
+	if err := config.SaveClusterState(cacheDir, dst); err != nil {
+		return err
+	}
+
+	// the CAs are kept, so service account tokens stored in etcd stay
+	// valid; start reissues everything tied to addresses and node names
+	err = copyDir(path.Join(cacheDir, srcName, "certificates"), path.Join(cacheDir, dstName, "certificates"))
+	if err != nil {
+		return err
+	}
+
+	log.Default().Printf("cloned cluster %s into %s, starting it", srcName, dstName)
+	if err := provisionCluster(ctx, dstName, false); err != nil {
+		return err
+	}
+
+	return replaceKubeNodes(ctx, path.Join(cacheDir, dstName), src.Nodes, names)
+}
+
+// replaceKubeNodes replaces the Kubernetes nodes of the controller and
+// workers in nodes, which a copied etcd still has, with the nodes of the
+// containers they were copied to, named by names.
+func replaceKubeNodes(ctx *cli.Context, clusterDir string, nodes []config.Node, names map[string]string) error {
+	clientset, err := kubernetes.GetClientset(path.Join(clusterDir, "kubeconfigs", "client.kubeconfig"))
+	if err != nil {
+		return err
+	}
+
+	var kubeNodes []string
+	for _, node := range nodes {
+		if node.Role == config.RoleController || node.Role == config.RoleWorker {
+			kubeNodes = append(kubeNodes, node.Name)
+		}
+	}
+
+	return forEachNode(kubeNodes, ctx.Int("parallelism"), func(oldName string) error {
+		nctx, cancel := phaseContext(ctx, "node-timeout")
+		defer cancel()
+
+		return kubernetes.ReplaceNode(nctx, *clientset, oldName, names[oldName])
+	})
+}
+
+// createNetworkAndPool creates the network and storage pool of state, unless
+// it already names existing ones, and returns a function that deletes what
+// was created again.
+func createNetworkAndPool(state *config.ClusterState, is lxdclient.InstanceServer) (func(), error) {
+	createdNetwork, createdPool := false, false
+	rollback := func() {
+		if createdNetwork {
+			if err := deleteNetwork(*state, is); err != nil {
+				log.Default().Printf("network %s was not deleted", state.NetworkID)
+			}
+		}
+		if createdPool {
+			if err := deleteStoragePool(*state, is); err != nil {
+				log.Default().Printf("storage pool %s was not deleted", state.StoragePool)
+			}
+		}
+	}
+
+	var err error
+	if state.NetworkID == "" {
+		state.NetworkID, err = createNetwork(*state, is)
+		if err != nil {
+			return nil, err
+		}
+		createdNetwork = true
+	}
+	if state.StoragePool == "" {
+		state.StoragePool, err = createStoragePool(*state, is)
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		createdPool = true
+	}
+
+	return rollback, nil
+}
+
+// cloneContainers copies every container of src from its snapshot into dst,
+// returning the name of each copy by the name of its source. If any copy
+// fails the copies made are deleted again.
+func cloneContainers(src, dst config.ClusterState, snapshot string, addresses map[string]string, parallelism int, is lxdclient.InstanceServer) (map[string]string, error) {
+	var mu sync.Mutex
+	names := make(map[string]string)
+	err := forEachNode(src.Containers, parallelism, func(container string) error {
+		node, ok := src.Node(container)
+		if !ok {
+			return fmt.Errorf("node %s is not in the cluster state", container)
+		}
+
+		conf := containers.ContainerConfig{
+			ImageName:   node.Role,
+			ClusterName: dst.Name,
+			StoragePool: dst.StoragePool,
+			NetworkID:   dst.NetworkID,
+			Profile:     dst.Profile,
+			IPv4:        addresses[container],
+		}
+		log.Default().Printf("copying %s", container)
+		name, err := containers.CloneContainer(container, snapshot, conf, is)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		names[container] = name
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		for _, name := range names {
+			if err := containers.DeleteContainer(name, is); err != nil {
+				log.Default().Printf("%s was not deleted: %s", name, err)
+			}
+		}
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// copyDir copies the files in src into dst, which is created.
+func copyDir(src, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return fmt.Errorf("could not mkdir %s: %w", dst, err)
+	}
+
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(path.Join(src, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path.Join(dst, entry.Name()), data, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/greymatter-io/lxdk/config"
+	"github.com/greymatter-io/lxdk/lxd"
+	lxdclient "github.com/lxc/lxd/client"
+	"github.com/urfave/cli/v2"
+)
+
+// remoteFlags select the LXD remote and project for commands that don't act
+// on a cluster recorded in the cache, which remembers its own.
+var remoteFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "remote",
+		Usage: "lxc remote to use instead of the default remote",
+	},
+	&cli.StringFlag{
+		Name:  "project",
+		Usage: "lxd project to use instead of the default project",
+	},
+}
+
+// lxdConfigPath returns the lxc config path given with --lxdconfig, or an
+// empty string to let lxd.Connect find the config the lxc client uses.
+func lxdConfigPath(ctx *cli.Context) string {
+	if ctx.IsSet("lxdconfig") {
+		return ctx.String("lxdconfig")
+	}
+
+	return ""
+}
+
+// connectCluster connects to the LXD remote and project the cluster was
+// created on.
+func connectCluster(ctx *cli.Context, state config.ClusterState) (lxdclient.InstanceServer, string, error) {
+	return lxd.Connect(lxd.ConnectOptions{
+		ConfigPath: lxdConfigPath(ctx),
+		Remote:     state.Remote,
+		Project:    state.Project,
+	})
+}
+
+// connectFlags connects to the LXD remote and project selected by
+// remoteFlags.
+func connectFlags(ctx *cli.Context) (lxdclient.InstanceServer, string, error) {
+	return lxd.Connect(lxd.ConnectOptions{
+		ConfigPath: lxdConfigPath(ctx),
+		Remote:     ctx.String("remote"),
+		Project:    ctx.String("project"),
+	})
+}
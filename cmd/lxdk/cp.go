@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/greymatter-io/lxdk/config"
+	"github.com/greymatter-io/lxdk/containers"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// cpCmd copies files and directory trees between the local filesystem and a
+// node, which is named by role like in shell and exec.
+var cpCmd = &cli.Command{
+	Name:      "cp",
+	Usage:     "copy files and directories to or from a node",
+	ArgsUsage: "<src> <dst>",
+	Description: "One of src and dst is a local path, the other is <cluster>:<node>:/path, where node is " +
+		"etcd, controller, registry, worker-<n> or a container name. Directories are copied " +
+		"recursively, keeping file modes and owners. If dst is an existing directory, src is " +
+		"copied into it.",
+	Action: doCp,
+}
+
+// nodePath is a path on a node of a cluster.
+type nodePath struct {
+	Cluster string
+	Node    string
+	Path    string
+}
+
+// parseNodePath parses <cluster>:<node>:/path, returning false if arg is a
+// local path.
+func parseNodePath(arg string) (nodePath, bool) {
+	parts := strings.SplitN(arg, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || !strings.HasPrefix(parts[2], "/") {
+		return nodePath{}, false
+	}
+	if strings.Contains(parts[0], "/") || strings.Contains(parts[1], "/") {
+		return nodePath{}, false
+	}
+
+	return nodePath{Cluster: parts[0], Node: parts[1], Path: path.Clean(parts[2])}, true
+}
+
+func doCp(ctx *cli.Context) error {
+	if ctx.Args().Len() != 2 {
+		return errors.New("must supply a source and a destination")
+	}
+	src, dst := ctx.Args().Get(0), ctx.Args().Get(1)
+
+	remoteSrc, srcIsRemote := parseNodePath(src)
+	remoteDst, dstIsRemote := parseNodePath(dst)
+	if srcIsRemote == dstIsRemote {
+		return errors.New("exactly one of source and destination must be <cluster>:<node>:/path")
+	}
+
+	remote := remoteSrc
+	if dstIsRemote {
+		remote = remoteDst
+	}
+
+	state, err := config.LoadClusterState(ctx.String("cache"), remote.Cluster)
+	if err != nil {
+		return err
+	}
+
+	nodes, err := state.ResolveNodes(remote.Node)
+	if err != nil {
+		return err
+	}
+	if len(nodes) != 1 {
+		return errors.Errorf("%s is %d nodes, cp needs exactly one", remote.Node, len(nodes))
+	}
+	node := nodes[0]
+
+	is, _, err := connectCluster(ctx, state)
+	if err != nil {
+		return err
+	}
+
+	if srcIsRemote {
+		if stat, err := os.Stat(dst); err == nil && stat.IsDir() {
+			dst = path.Join(dst, path.Base(remoteSrc.Path))
+		}
+		if err := containers.PullTree(node, remoteSrc.Path, dst, is); err != nil {
+			return err
+		}
+		log.Default().Printf("copied %s:%s to %s", node, remoteSrc.Path, dst)
+		return nil
+	}
+
+	to := remoteDst.Path
+	if containers.IsDir(node, to, is) {
+		to = path.Join(to, path.Base(path.Clean(src)))
+	}
+	if err := containers.PushTree(src, node, to, is); err != nil {
+		return err
+	}
+	log.Default().Printf("copied %s to %s:%s", src, node, to)
+
+	return nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestParseNodePath(t *testing.T) {
+	tests := []struct {
+		arg    string
+		want   nodePath
+		remote bool
+	}{
+		{"dev:controller:/etc/kubernetes", nodePath{"dev", "controller", "/etc/kubernetes"}, true},
+		{"dev:worker-2:/var/log/", nodePath{"dev", "worker-2", "/var/log"}, true},
+		{"./audit.log", nodePath{}, false},
+		{"/tmp/a:b:/c", nodePath{}, false},
+		{"dev:controller:relative", nodePath{}, false},
+		{"C:file", nodePath{}, false},
+	}
+
+	for _, tt := range tests {
+		got, remote := parseNodePath(tt.arg)
+		if remote != tt.remote || got != tt.want {
+			t.Errorf("parseNodePath(%q) = %+v, %v, want %+v, %v", tt.arg, got, remote, tt.want, tt.remote)
+		}
+	}
+}
@@ -6,11 +6,14 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"time"
 
 	certs "github.com/greymatter-io/lxdk/certificates"
 	"github.com/greymatter-io/lxdk/config"
 	"github.com/greymatter-io/lxdk/containers"
 	"github.com/greymatter-io/lxdk/lxd"
+	"github.com/greymatter-io/lxdk/version"
 	lxdclient "github.com/lxc/lxd/client"
 	"github.com/lxc/lxd/shared/api"
 	"github.com/pkg/errors"
@@ -40,24 +43,70 @@ var (
 				Usage: "the number of worker nodes to create",
 				Value: 1,
 			},
+			&cli.StringFlag{
+				Name:  "cgroup",
+				Usage: "cgroup hierarchy for nodes to run under: auto, v1 or v2",
+				Value: "auto",
+			},
+			&cli.StringFlag{
+				Name:  "kubernetes-version",
+				Usage: "launch nodes from the lxdk-<role>-<version> images, e.g. v1.23.1, instead of the kubedee-<role> images",
+			},
+			&cli.BoolFlag{
+				Name:  "unprivileged",
+				Usage: "run nodes as unprivileged containers, see the README for what doesn't work in them",
+			},
+			&cli.StringSliceFlag{
+				Name:  "image",
+				Usage: "image alias or fingerprint to launch a role from, as role=image, e.g. worker=lxdk-worker-dev",
+			},
+			mountFlag,
+			remoteFlags[0],
+			remoteFlags[1],
 		},
 		Action: doCreate,
 	}
 )
 
-func doCreate(ctx *cli.Context) error {
+func doCreate(ctx *cli.Context) (err error) {
 	var state config.ClusterState
 	state.StorageDriver = ctx.String("storage-driver")
 	state.StoragePool = ctx.String("storage-pool")
 	state.NetworkID = ctx.String("network")
 
 	state.RunState = config.Uninitialized
+	state.LXDKVersion = version.Version()
+	state.CreateFlags = createFlags(ctx)
 
-	is, _, err := lxd.InstanceServerConnect()
+	state.Remote = ctx.String("remote")
+	if state.Remote == "" {
+		state.Remote, err = lxd.DefaultRemote(lxdConfigPath(ctx))
+		if err != nil {
+			return err
+		}
+	}
+	state.Project = ctx.String("project")
+
+	is, hostname, err := connectCluster(ctx, state)
 	if err != nil {
 		return err
 	}
 
+	switch ctx.String("cgroup") {
+	case "auto":
+		state.CgroupMode, err = containers.DetectCgroupMode(is, hostname == "")
+		if err != nil {
+			return err
+		}
+	case containers.CgroupV1, containers.CgroupV2:
+		state.CgroupMode = ctx.String("cgroup")
+	default:
+		return errors.Errorf("unknown cgroup mode %s, must be auto, v1 or v2", ctx.String("cgroup"))
+	}
+	state.Unprivileged = ctx.Bool("unprivileged")
+	state.Profile = containers.ProfileName(state.CgroupMode, state.Unprivileged)
+	log.Default().Printf("using cgroup %s profile %s", state.CgroupMode, state.Profile)
+
 	cacheDir := ctx.String("cache")
 
 	if ctx.Args().Len() == 0 {
@@ -73,68 +122,85 @@ func doCreate(ctx *cli.Context) error {
 		return errors.Errorf("cluster %s already exists at path %s", clusterName, path)
 	}
 
-	if state.NetworkID == "" {
-		networkID, err := createNetwork(state, is)
-		if err != nil {
-			return err
-		}
-		state.NetworkID = networkID
+	// check every image exists before creating anything
+	refs, err := imageRefs(ctx)
+	if err != nil {
+		return err
 	}
-
-	if state.StoragePool == "" {
-		state.StoragePool, err = createStoragePool(state, is)
-		if err != nil {
-			if err := deleteNetwork(state, is); err != nil {
-				log.Default().Printf("network %s was not deleted", state.NetworkID)
-			}
-
-			return err
-		}
+	state.Images, err = resolveImages(refs, is)
+	if err != nil {
+		return err
 	}
-	log.Default().Println("using storage pool:", state.StoragePool)
+	state.KubernetesVersion = ctx.String("kubernetes-version")
 
-	profs, err := is.GetProfileNames()
+	state.Mounts, err = mountFlags(ctx)
 	if err != nil {
 		return err
 	}
 
-	profExists := false
-	for _, prof := range profs {
-		if prof == "lxdk" {
-			profExists = true
-			break
-		}
+	rollbackNetwork, err := createNetworkAndPool(&state, is)
+	if err != nil {
+		return err
 	}
+	log.Default().Println("using storage pool:", state.StoragePool)
 
-	if !profExists {
-		if err = containers.CreateContainerProfile(is); err != nil {
-			return err
+	// everything created from here on is deleted again if create fails, so
+	// gc doesn't have to clean up after it
+	createdProfile := false
+	var createdContainers []string
+	defer func() {
+		if err == nil {
+			return
 		}
-	}
 
-	containerNames, err := createContainers(state, ctx.Int("num-workers"), is)
-	if err != nil {
-		if err := deleteNetwork(state, is); err != nil {
-			log.Default().Printf("network %s was not deleted", state.NetworkID)
+		for _, name := range createdContainers {
+			if err := containers.DeleteContainer(name, is); err != nil {
+				log.Default().Printf("%s was not deleted: %s", name, err)
+			}
+		}
+		if createdProfile {
+			if err := deleteProfile(state.Profile, is); err != nil {
+				log.Default().Printf("profile %s was not deleted: %s", state.Profile, err)
+			}
 		}
-		if strings.Contains(state.StoragePool, "lxdk") {
-			if err := deleteStoragePool(state, is); err != nil {
-				log.Default().Printf("storage pool %s was not deleted", state.StoragePool)
+		rollbackNetwork()
+		if len(createdContainers) > 0 {
+			if err := os.RemoveAll(path); err != nil {
+				log.Default().Printf("%s was not removed: %s", path, err)
 			}
 		}
+	}()
+
+	createdProfile, err = ensureProfile(state, is)
+	if err != nil {
+		return err
+	}
 
+	containerNames, addresses, err := createContainers(ctx, state, ctx.Int("num-workers"), is)
+	if err != nil {
 		return err
 	}
+	for _, names := range containerNames {
+		createdContainers = append(createdContainers, names...)
+	}
 	state.EtcdContainerName = containerNames["etcd"][0]
 	state.ControllerContainerName = containerNames["controller"][0]
 	state.RegistryContainerName = containerNames["registry"][0]
 	state.WorkerContainerNames = containerNames["worker"]
 
-	for _, names := range containerNames {
-		for _, name := range names {
+	for _, role := range []string{config.RoleEtcd, config.RoleController, config.RoleRegistry, config.RoleWorker} {
+		for _, name := range containerNames[role] {
 			state.Containers = append(state.Containers, name)
+
+			node, err := newNode(name, role, refs[role], is)
+			if err != nil {
+				return err
+			}
+			node.StaticIP = addresses[name]
+			state.SetNode(node)
 		}
 	}
+	state.CreatedAt = time.Now().UTC()
 
 	err = config.WriteClusterState(ctx, state)
 	if err != nil {
@@ -149,12 +215,112 @@ func doCreate(ctx *cli.Context) error {
 	return nil
 }
 
+// ensureProfile creates the LXD profile the nodes of state use, unless it
+// already exists, and returns true if it was created.
+func ensureProfile(state config.ClusterState, is lxdclient.InstanceServer) (bool, error) {
+	profs, err := is.GetProfileNames()
+	if err != nil {
+		return false, err
+	}
+
+	for _, prof := range profs {
+		if prof == state.Profile {
+			return false, nil
+		}
+	}
+
+	if err := containers.CreateContainerProfile(state.CgroupMode, state.Unprivileged, is); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// createFlags returns the value of every flag of the running command (create
+// or up), so the cluster state records how the cluster was created.
+func createFlags(ctx *cli.Context) map[string]string {
+	flags := make(map[string]string)
+	if ctx.Command == nil {
+		return flags
+	}
+
+	for _, flag := range ctx.Command.Flags {
+		name := flag.Names()[0]
+		flags[name] = fmt.Sprint(ctx.Value(name))
+	}
+
+	return flags
+}
+
+// newNode describes a freshly created container, launched from the image
+// imageRef refers to, for the cluster state.
+func newNode(name, role, imageRef string, is lxdclient.InstanceServer) (config.Node, error) {
+	fingerprint, err := containers.GetContainerImage(name, is)
+	if err != nil {
+		return config.Node{}, err
+	}
+
+	return config.Node{
+		Name:             name,
+		Role:             role,
+		ImageAlias:       imageRef,
+		ImageFingerprint: fingerprint,
+	}, nil
+}
+
+// imageRefs returns the image alias or fingerprint each role is launched from,
+// from --kubernetes-version and any --image overrides.
+func imageRefs(ctx *cli.Context) (map[string]string, error) {
+	roles := []string{config.RoleEtcd, config.RoleController, config.RoleWorker, config.RoleRegistry}
+
+	refs := make(map[string]string)
+	for _, role := range roles {
+		refs[role] = containers.VersionedImageAlias(role, ctx.String("kubernetes-version"))
+	}
+
+	for _, override := range ctx.StringSlice("image") {
+		split := strings.SplitN(override, "=", 2)
+		if len(split) != 2 || split[1] == "" {
+			return nil, errors.Errorf("invalid --image %s, must be role=image", override)
+		}
+		if _, ok := refs[split[0]]; !ok {
+			return nil, errors.Errorf("invalid --image %s, role must be one of %s", override, strings.Join(roles, ", "))
+		}
+		refs[split[0]] = split[1]
+	}
+
+	return refs, nil
+}
+
+// resolveImages resolves the image of every role to a fingerprint, and fails
+// listing every missing image if any can't be found.
+func resolveImages(refs map[string]string, is lxdclient.InstanceServer) (map[string]string, error) {
+	fingerprints := make(map[string]string)
+	var missing []string
+	for _, role := range []string{config.RoleEtcd, config.RoleController, config.RoleWorker, config.RoleRegistry} {
+		fingerprint, err := containers.ResolveImage(refs[role], is)
+		if err != nil {
+			missing = append(missing, fmt.Sprintf("%s (%s)", role, refs[role]))
+			continue
+		}
+		fingerprints[role] = fingerprint
+	}
+
+	if len(missing) > 0 {
+		return nil, errors.Errorf("images are missing for: %s; import them into LXD or choose others with --kubernetes-version or --image",
+			strings.Join(missing, ", "))
+	}
+
+	return fingerprints, nil
+}
+
 func createNetwork(state config.ClusterState, is lxdclient.InstanceServer) (string, error) {
 	networkID := "lxdk-" + state.Name
 
 	networkPost := api.NetworksPost{}
 	networkPost.Name = networkID
-	networkPost.Config = map[string]string{"ipv6.address": "none"}
+	networkPost.Config = containers.Metadata(state.Name, "")
+	networkPost.Config["ipv6.address"] = "none"
 	err := is.CreateNetwork(networkPost)
 	return networkID, err
 }
@@ -206,15 +372,7 @@ func createCerts(cacheDir string) error {
 	}
 
 	// admin cert
-	adminCertConfig := certs.CertConfig{
-		Name:         "admin",
-		CN:           "admin",
-		JSONOverride: certs.CertJSON("admin", "system:masters"),
-		CA:           kubeCAConf,
-		Dir:          path,
-		CAConfigPath: caConfigPath,
-	}
-	err = certs.CreateCert(adminCertConfig)
+	err = createAdminCert(path, caConfigPath)
 	if err != nil {
 		return err
 	}
@@ -277,11 +435,31 @@ func createCerts(cacheDir string) error {
 	return nil
 }
 
+// createAdminCert issues the cluster-admin client cert from the Kubernetes CA
+// in certDir.
+func createAdminCert(certDir, caConfigPath string) error {
+	adminCertConfig := certs.CertConfig{
+		Name:         "admin",
+		CN:           "admin",
+		JSONOverride: certs.CertJSON("admin", "system:masters"),
+		CA: certs.CAConfig{
+			Name: "ca",
+			Dir:  certDir,
+			CN:   "Kubernetes",
+		},
+		Dir:          certDir,
+		CAConfigPath: caConfigPath,
+	}
+
+	return certs.CreateCert(adminCertConfig)
+}
+
 func createStoragePool(state config.ClusterState, is lxdclient.InstanceServer) (string, error) {
 	stPoolPost := api.StoragePoolsPost{
 		Name:   "lxdk-" + state.Name,
 		Driver: state.StorageDriver,
 	}
+	stPoolPost.Config = containers.Metadata(state.Name, "")
 	if err := is.CreateStoragePool(stPoolPost); err != nil {
 		return "", err
 	}
@@ -289,31 +467,73 @@ func createStoragePool(state config.ClusterState, is lxdclient.InstanceServer) (
 	return stPoolPost.Name, nil
 }
 
-func createContainers(state config.ClusterState, numWorkers int, is lxdclient.InstanceServer) (map[string][]string, error) {
-	created := make(map[string][]string)
-	created["worker"] = []string{}
-	for _, image := range []string{"etcd", "controller", "worker", "registry"} {
-		for i := 0; i < numWorkers; i++ {
-			conf := containers.ContainerConfig{
-				ImageName:   image,
-				ClusterName: state.Name,
-				StoragePool: state.StoragePool,
-				NetworkID:   state.NetworkID,
-			}
-			containerName, err := containers.CreateContainer(conf, is)
+// createContainers creates the containers of every role, at most
+// --parallelism at a time, and returns their names by role. If any container
+// fails to be created, or lxdk is interrupted, the ones that were are deleted
+// again.
+func createContainers(ctx *cli.Context, state config.ClusterState, numWorkers int, is lxdclient.InstanceServer) (map[string][]string, map[string]string, error) {
+	// nodes are labeled by role, and workers by their number, until LXD
+	// has named them
+	roles := map[string]string{
+		config.RoleEtcd:       config.RoleEtcd,
+		config.RoleController: config.RoleController,
+		config.RoleRegistry:   config.RoleRegistry,
+	}
+	labels := []string{config.RoleEtcd, config.RoleController, config.RoleRegistry}
+	for i := 1; i <= numWorkers; i++ {
+		label := fmt.Sprintf("%s-%d", config.RoleWorker, i)
+		roles[label] = config.RoleWorker
+		labels = append(labels, label)
+	}
+
+	labelAddresses, err := allocateAddresses(state, labels, is)
+	if err != nil {
+		return nil, nil, err
+	}
 
-			if err != nil {
-				return nil, err
-			}
+	var mu sync.Mutex
+	names := make(map[string]string)
+	err = forEachNode(labels, ctx.Int("parallelism"), func(label string) error {
+		if err := interrupted(ctx); err != nil {
+			return err
+		}
 
-			if image != "worker" {
-				created[image] = []string{containerName}
-				break
-			}
+		conf := containers.ContainerConfig{
+			ImageName:   roles[label],
+			ClusterName: state.Name,
+			StoragePool: state.StoragePool,
+			NetworkID:   state.NetworkID,
+			Profile:     state.Profile,
+			Image:       state.Images[roles[label]],
+			IPv4:        labelAddresses[label],
+		}
+		log.Default().Printf("creating %s", label)
+		containerName, err := containers.CreateContainer(ctx.Context, conf, is)
+		if err != nil {
+			return err
+		}
 
-			created["worker"] = append(created["worker"], containerName)
+		mu.Lock()
+		names[label] = containerName
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		for label, name := range names {
+			if err := containers.DeleteContainer(name, is); err != nil {
+				log.Default().Printf("%s (%s) was not deleted: %s", label, name, err)
+			}
 		}
+		return nil, nil, err
+	}
+
+	created := make(map[string][]string)
+	created[config.RoleWorker] = []string{}
+	addresses := make(map[string]string)
+	for _, label := range labels {
+		created[roles[label]] = append(created[roles[label]], names[label])
+		addresses[names[label]] = labelAddresses[label]
 	}
 
-	return created, nil
+	return created, addresses, nil
 }
@@ -8,7 +8,6 @@ import (
 
 	"github.com/greymatter-io/lxdk/config"
 	"github.com/greymatter-io/lxdk/containers"
-	"github.com/greymatter-io/lxdk/lxd"
 	lxdclient "github.com/lxc/lxd/client"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli/v2"
@@ -46,12 +45,19 @@ func doDelete(ctx *cli.Context) error {
 		return err
 	}
 
-	is, _, err := lxd.InstanceServerConnect()
+	is, _, err := connectCluster(ctx, state)
 	if err != nil {
 		return err
 	}
 
-	err = deleteContainers(state, is)
+	return deleteCluster(state, path, ctx.Bool("delete-storage"), ctx.Bool("delete-network"), is)
+}
+
+// deleteCluster deletes the containers of state and its cache directory
+// clusterDir, and its storage pool and network if asked to and they were
+// created by lxdk.
+func deleteCluster(state config.ClusterState, clusterDir string, deleteStorage, deleteNet bool, is lxdclient.InstanceServer) error {
+	err := deleteContainers(state, is)
 	if err != nil {
 		return err
 	}
@@ -59,21 +65,21 @@ func doDelete(ctx *cli.Context) error {
 	if !strings.Contains(state.StoragePool, "lxdk") {
 		log.Default().Printf("storage pool %s was not created by lxdk and will not be deleted", state.StoragePool)
 	}
-	if ctx.Bool("delete-storage") && strings.Contains(state.StoragePool, "lxdk") {
+	if deleteStorage && strings.Contains(state.StoragePool, "lxdk") {
 		err = deleteStoragePool(state, is)
 		if err != nil {
 			return err
 		}
 	}
 
-	if ctx.Bool("delete-network") && strings.Contains(state.NetworkID, "lxdk") {
+	if deleteNet && strings.Contains(state.NetworkID, "lxdk") {
 		err = deleteNetwork(state, is)
 		if err != nil {
 			return err
 		}
 	}
 
-	err = os.RemoveAll(path)
+	err = os.RemoveAll(clusterDir)
 	if err != nil {
 		return err
 	}
@@ -110,8 +116,8 @@ func deleteContainers(state config.ClusterState, is lxdclient.InstanceServer) er
 	return nil
 }
 
-func deleteProfile(state config.ClusterState, is lxdclient.InstanceServer) error {
-	err := is.DeleteProfile("lxdk")
+func deleteProfile(name string, is lxdclient.InstanceServer) error {
+	err := is.DeleteProfile(name)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/greymatter-io/lxdk/config"
+	"github.com/greymatter-io/lxdk/containers"
+	lxdclient "github.com/lxc/lxd/client"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// attachDevices passes the host devices config.toml lists for their role
+// through to nodes. Devices are resolved against the LXD server the nodes
+// run on.
+func attachDevices(ctx *cli.Context, nodes []config.Node, is lxdclient.InstanceServer) error {
+	conf, err := config.CLIConfigFromCLIContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	host := &deviceHost{is: is}
+	for _, node := range nodes {
+		devices, err := resolveDevices(conf.RoleDevices(node.Role), host)
+		if err != nil {
+			return fmt.Errorf("could not resolve devices for %s: %w", node.Name, err)
+		}
+
+		log.Default().Printf("attaching %d devices to %s", len(devices), node.Name)
+		if err := containers.SetHostDevices(node.Name, devices, is); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolveDevices turns conf into LXD devices, keyed by name. Every device
+// but required custom ones is passed with required=false, so LXD skips it
+// until the server has it.
+func resolveDevices(conf config.DeviceConfig, host *deviceHost) (map[string]map[string]string, error) {
+	devices := make(map[string]map[string]string)
+	optional := func(name, typ, source string) {
+		devices[name] = map[string]string{
+			"type":     typ,
+			"source":   source,
+			"path":     source,
+			"required": "false",
+		}
+	}
+
+	for i := 0; i < conf.Loop; i++ {
+		name := "loop" + strconv.Itoa(i)
+		optional(name, "unix-block", path.Join("/dev", name))
+	}
+	if conf.Tun {
+		optional("tun", "unix-char", "/dev/net/tun")
+	}
+	if conf.Fuse {
+		optional("fuse", "unix-char", "/dev/fuse")
+	}
+	if conf.KVM {
+		kvm, err := host.kvm()
+		if err != nil {
+			return nil, err
+		}
+		if kvm {
+			optional("kvm", "unix-char", "/dev/kvm")
+		} else {
+			log.Default().Println("LXD server can't run virtual machines, not passing /dev/kvm through")
+		}
+	}
+
+	for _, custom := range conf.Custom {
+		if custom.Type != "unix-char" && custom.Type != "unix-block" {
+			return nil, errors.Errorf("device %s has type %q, must be unix-char or unix-block", custom.Source, custom.Type)
+		}
+
+		source := custom.Source
+		if !path.IsAbs(source) {
+			if custom.Type != "unix-block" {
+				return nil, errors.Errorf("unix-char device %s must be an absolute path", custom.Source)
+			}
+
+			disk, err := host.disk(source)
+			if err != nil {
+				return nil, err
+			}
+			if disk == "" {
+				if custom.Required {
+					return nil, errors.Errorf("LXD server has no disk %s", custom.Source)
+				}
+				log.Default().Printf("LXD server has no disk %s, skipping it", custom.Source)
+				continue
+			}
+			source = disk
+		}
+
+		name := custom.Name
+		if name == "" {
+			name = strings.ReplaceAll(strings.TrimPrefix(source, "/dev/"), "/", "-")
+		}
+		dest := custom.Path
+		if dest == "" {
+			dest = source
+		}
+
+		devices[name] = map[string]string{
+			"type":     custom.Type,
+			"source":   source,
+			"path":     dest,
+			"required": strconv.FormatBool(custom.Required),
+		}
+	}
+
+	return devices, nil
+}
+
+// deviceHost answers questions about the devices of an LXD server, asking
+// the server at most once.
+type deviceHost struct {
+	is    lxdclient.InstanceServer
+	disks map[string]bool
+	qemu  *bool
+}
+
+// kvm returns true if the server can run virtual machines, and so has
+// /dev/kvm.
+func (h *deviceHost) kvm() (bool, error) {
+	if h.qemu == nil {
+		server, _, err := h.is.GetServer()
+		if err != nil {
+			return false, fmt.Errorf("could not get LXD server info: %w", err)
+		}
+
+		qemu := strings.Contains(server.Environment.Driver, "qemu")
+		h.qemu = &qemu
+	}
+
+	return *h.qemu, nil
+}
+
+// disk returns the device path of the disk the server reports as id, or
+// "" if there is no such disk.
+func (h *deviceHost) disk(id string) (string, error) {
+	if h.disks == nil {
+		resources, err := h.is.GetServerResources()
+		if err != nil {
+			return "", fmt.Errorf("could not get LXD server resources: %w", err)
+		}
+
+		h.disks = make(map[string]bool)
+		for _, disk := range resources.Storage.Disks {
+			h.disks[disk.ID] = true
+		}
+	}
+
+	if !h.disks[id] {
+		return "", nil
+	}
+
+	return path.Join("/dev", id), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/greymatter-io/lxdk/config"
+)
+
+func TestResolveDevices(t *testing.T) {
+	conf := config.DeviceConfig{
+		Loop: 2,
+		Tun:  true,
+		Fuse: true,
+		Custom: []config.CustomDevice{
+			{Type: "unix-char", Source: "/dev/net/ppp", Required: true},
+			{Name: "data", Type: "unix-block", Source: "/dev/vdb", Path: "/dev/data"},
+		},
+	}
+
+	got, err := resolveDevices(conf, &deviceHost{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]map[string]string{
+		"loop0":   {"type": "unix-block", "source": "/dev/loop0", "path": "/dev/loop0", "required": "false"},
+		"loop1":   {"type": "unix-block", "source": "/dev/loop1", "path": "/dev/loop1", "required": "false"},
+		"tun":     {"type": "unix-char", "source": "/dev/net/tun", "path": "/dev/net/tun", "required": "false"},
+		"fuse":    {"type": "unix-char", "source": "/dev/fuse", "path": "/dev/fuse", "required": "false"},
+		"net-ppp": {"type": "unix-char", "source": "/dev/net/ppp", "path": "/dev/net/ppp", "required": "true"},
+		"data":    {"type": "unix-block", "source": "/dev/vdb", "path": "/dev/data", "required": "false"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("resolveDevices = %v, want %v", got, want)
+	}
+}
+
+func TestResolveDevicesInvalid(t *testing.T) {
+	for _, custom := range []config.CustomDevice{
+		{Type: "disk", Source: "/dev/sdb"},
+		{Type: "unix-char", Source: "ttyUSB0"},
+	} {
+		conf := config.DeviceConfig{Custom: []config.CustomDevice{custom}}
+		if _, err := resolveDevices(conf, &deviceHost{}); err == nil {
+			t.Errorf("resolveDevices(%+v) succeeded, want an error", custom)
+		}
+	}
+}
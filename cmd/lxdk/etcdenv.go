@@ -7,8 +7,6 @@ import (
 	"path"
 
 	"github.com/greymatter-io/lxdk/config"
-	"github.com/greymatter-io/lxdk/containers"
-	"github.com/greymatter-io/lxdk/lxd"
 	"github.com/urfave/cli/v2"
 )
 
@@ -33,14 +31,24 @@ func doEtcdenv(ctx *cli.Context) error {
 
 	log.Default().SetOutput(ioutil.Discard)
 
-	is, hostname, err := lxd.InstanceServerConnect()
-	if err != nil {
-		return err
+	etcdIP := ""
+	if node, ok := state.Node(state.EtcdContainerName); ok {
+		etcdIP = node.IP
 	}
 
-	etcdIP, err := containers.WaitContainerIP(state.EtcdContainerName, []string{hostname}, is)
-	if err != nil {
-		return err
+	// clusters that haven't been started since addresses were recorded
+	// have to ask LXD
+	if etcdIP == "" {
+		is, hostname, err := connectCluster(ctx, state)
+		if err != nil {
+			return err
+		}
+
+		ip, err := waitIP(ctx, state.EtcdContainerName, hostname, is)
+		if err != nil {
+			return err
+		}
+		etcdIP = ip.String()
 	}
 
 	cert := func(name string) string { return path.Join(certDir, name+".pem") }
@@ -48,7 +56,7 @@ func doEtcdenv(ctx *cli.Context) error {
 	fmt.Println("ETCDCTL_CERT=" + cert("etcd"))
 	fmt.Println("ETCDCTL_KEY=" + cert("etcd-key"))
 	fmt.Println("ETCD_INSECURE_TRANSPORT=false")
-	fmt.Println("ETCD_ENDPOINTS=" + etcdIP.String())
+	fmt.Println("ETCD_ENDPOINTS=" + etcdIP)
 	fmt.Println("ETCD_API=3")
 
 	return nil
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/greymatter-io/lxdk/config"
+	"github.com/greymatter-io/lxdk/containers"
+	"github.com/urfave/cli/v2"
+)
+
+// execCmd runs a command on some or all nodes of a cluster, prefixing each
+// line of output with the node it came from.
+var execCmd = &cli.Command{
+	Name:      "exec",
+	Usage:     "run a command on nodes of a cluster",
+	ArgsUsage: "<cluster name> -- <command...>",
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:    "node",
+			Aliases: []string{"n"},
+			Usage:   "node to run on: etcd, controller, registry, worker, worker-<n>, all or a container name; may be repeated",
+			Value:   cli.NewStringSlice("all"),
+		},
+		&cli.BoolFlag{
+			Name:  "shell",
+			Usage: "run the command with sh -c, so pipes and redirects work",
+		},
+	},
+	Action: doExec,
+}
+
+func doExec(ctx *cli.Context) error {
+	state, err := config.ClusterStateFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	command := commandArgs(ctx.Args().Tail())
+	if len(command) == 0 {
+		return errors.New("must supply command")
+	}
+	if ctx.Bool("shell") {
+		command = containers.ShellCommand(strings.Join(command, " "))
+	}
+
+	nodes, err := selectNodes(state, ctx.StringSlice("node"))
+	if err != nil {
+		return err
+	}
+
+	is, _, err := connectCluster(ctx, state)
+	if err != nil {
+		return err
+	}
+
+	var outMu sync.Mutex
+	var codeMu sync.Mutex
+	exitCode := 0
+	err = forEachNode(nodes, ctx.Int("parallelism"), func(node string) error {
+		stdout := newPrefixWriter(os.Stdout, node, &outMu)
+		stderr := newPrefixWriter(os.Stderr, node, &outMu)
+		defer stdout.Flush()
+		defer stderr.Flush()
+
+		_, err := containers.ExecContext(ctx.Context, node, containers.ExecOptions{
+			Command: command,
+			Stdout:  stdout,
+			Stderr:  stderr,
+		}, is)
+
+		var execErr *containers.ExecError
+		if errors.As(err, &execErr) {
+			codeMu.Lock()
+			if execErr.Result.ExitCode > exitCode {
+				exitCode = execErr.Result.ExitCode
+			}
+			codeMu.Unlock()
+			return nil
+		}
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if exitCode != 0 {
+		return cli.Exit("", exitCode)
+	}
+
+	return nil
+}
+
+// selectNodes resolves node selectors to container names, dropping
+// duplicates and keeping the order they were given in.
+func selectNodes(state config.ClusterState, selectors []string) ([]string, error) {
+	var nodes []string
+	seen := make(map[string]bool)
+	for _, selector := range selectors {
+		names, err := state.ResolveNodes(selector)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				nodes = append(nodes, name)
+			}
+		}
+	}
+
+	return nodes, nil
+}
+
+// prefixWriter writes whole lines to w, each prefixed with the node they came
+// from. Writers for different nodes share mu so their lines don't interleave.
+type prefixWriter struct {
+	w      io.Writer
+	prefix []byte
+	mu     *sync.Mutex
+	buf    bytes.Buffer
+}
+
+func newPrefixWriter(w io.Writer, node string, mu *sync.Mutex) *prefixWriter {
+	return &prefixWriter{
+		w:      w,
+		prefix: []byte(fmt.Sprintf("[%s] ", node)),
+		mu:     mu,
+	}
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.buf.Write(data)
+
+	for {
+		i := bytes.IndexByte(p.buf.Bytes(), '\n')
+		if i < 0 {
+			return len(data), nil
+		}
+		if err := p.writeLine(p.buf.Next(i + 1)); err != nil {
+			return len(data), err
+		}
+	}
+}
+
+// Flush writes out a trailing line that wasn't terminated by a newline.
+func (p *prefixWriter) Flush() error {
+	if p.buf.Len() == 0 {
+		return nil
+	}
+
+	return p.writeLine(append(p.buf.Next(p.buf.Len()), '\n'))
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, err := p.w.Write(p.prefix); err != nil {
+		return err
+	}
+	_, err := p.w.Write(line)
+	return err
+}
+
+// commandArgs returns the command given after the cluster (and node) on the
+// command line. urfave/cli keeps the -- that separates it from lxdk's own
+// arguments, so it is dropped.
+func commandArgs(args []string) []string {
+	if len(args) > 0 && args[0] == "--" {
+		return args[1:]
+	}
+
+	return args
+}
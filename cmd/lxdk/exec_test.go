@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	var out bytes.Buffer
+	var mu sync.Mutex
+	w := newPrefixWriter(&out, "node", &mu)
+
+	w.Write([]byte("one\ntw"))
+	w.Write([]byte("o\nthree"))
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "[node] one\n[node] two\n[node] three\n"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestCommandArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{args: []string{"--", "ls", "-la"}, want: []string{"ls", "-la"}},
+		{args: []string{"ls", "-la"}, want: []string{"ls", "-la"}},
+		{args: []string{"ls", "--", "x"}, want: []string{"ls", "--", "x"}},
+		{args: []string{"--"}, want: []string{}},
+		{args: nil, want: nil},
+	}
+
+	for _, tt := range tests {
+		if got := commandArgs(tt.args); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("commandArgs(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/greymatter-io/lxdk/config"
+	"github.com/greymatter-io/lxdk/containers"
+	"github.com/greymatter-io/lxdk/lxd"
+	lxdclient "github.com/lxc/lxd/client"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// Cluster archives are tar files holding the cluster's cache directory under
+// archiveCacheDir and an LXD backup of every node, named after the node,
+// under archiveInstanceDir.
+const (
+	archiveCacheDir    = "cache"
+	archiveInstanceDir = "instances"
+)
+
+// exportCmd writes a cluster to an archive that importCmd can recreate it
+// from, on this LXD server or another.
+var exportCmd = &cli.Command{
+	Name:      "export",
+	Usage:     "write a cluster, with its nodes and cache directory, to an archive",
+	ArgsUsage: "<cluster name>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "output",
+			Aliases:  []string{"o"},
+			Usage:    "archive to write; .tar.zst (needs zstd), .tar.gz or .tar",
+			Required: true,
+		},
+		&cli.BoolFlag{
+			Name:  "stop",
+			Usage: "stop running nodes for the export and start them again afterwards",
+		},
+	},
+	Action: doExport,
+}
+
+// importCmd recreates a cluster from an archive written by exportCmd and
+// starts it. Host directories mounted into the exported cluster are left out,
+// as they may not exist on the importing host.
+var importCmd = &cli.Command{
+	Name:      "import",
+	Usage:     "recreate a cluster from an archive written by export",
+	ArgsUsage: "<archive>",
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "name",
+			Usage: "name to give the cluster instead of the one it was exported with",
+		},
+		&cli.StringFlag{
+			Name:  "storage-pool",
+			Usage: "lxd storage pool use, overrides storage pool creation",
+		},
+		&cli.StringFlag{
+			Name:  "network",
+			Usage: "network id of lxd network to use, overrides network creation",
+		},
+		mountFlag,
+	}, remoteFlags...),
+	Action: doImport,
+}
+
+func doExport(ctx *cli.Context) error {
+	state, err := config.ClusterStateFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	clusterDir := path.Join(ctx.String("cache"), state.Name)
+
+	is, _, err := connectCluster(ctx, state)
+	if err != nil {
+		return err
+	}
+
+	status, err := reconcileState(&state, is)
+	if err != nil {
+		return err
+	}
+	if len(status.Missing) > 0 {
+		return errors.Errorf("cluster %s is missing nodes %s and cannot be exported", state.Name, strings.Join(status.Missing, ", "))
+	}
+
+	// backups of running containers aren't consistent
+	if len(status.Running) > 0 {
+		if !ctx.Bool("stop") {
+			return errors.Errorf("nodes %s are running, stop the cluster or use --stop", strings.Join(status.Running, ", "))
+		}
+
+		parallelism := ctx.Int("parallelism")
+		err := forEachNode(status.Running, parallelism, func(container string) error {
+			log.Default().Println("stopping " + container)
+			return containers.StopContainer(container, is)
+		})
+		if err != nil {
+			return err
+		}
+		defer func() {
+			err := forEachNode(status.Running, parallelism, func(container string) error {
+				log.Default().Println("starting " + container)
+				return containers.StartContainer(ctx.Context, container, is)
+			})
+			if err != nil {
+				log.Default().Printf("could not start nodes again: %s", err)
+			}
+		}()
+	}
+
+	output := ctx.String("output")
+	if err := writeClusterArchive(output, clusterDir, state, is); err != nil {
+		os.Remove(output)
+		return err
+	}
+
+	log.Default().Printf("exported cluster %s to %s", state.Name, output)
+
+	return nil
+}
+
+// writeClusterArchive writes clusterDir and a backup of every node of state
+// to the archive filename.
+func writeClusterArchive(filename, clusterDir string, state config.ClusterState, is lxdclient.InstanceServer) error {
+	out, err := createArchive(filename)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(out)
+	if err := writeClusterTar(tw, clusterDir, state, is); err != nil {
+		out.Close()
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+func writeClusterTar(tw *tar.Writer, clusterDir string, state config.ClusterState, is lxdclient.InstanceServer) error {
+	err := filepath.Walk(clusterDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// backups made by state migrations stay behind
+		if !info.Mode().IsRegular() || strings.HasSuffix(p, ".bak") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(clusterDir, p)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return addToArchive(tw, path.Join(archiveCacheDir, filepath.ToSlash(rel)), info.Mode().Perm(), info.Size(), f)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, container := range state.Containers {
+		log.Default().Println("backing up " + container)
+		if err := addBackupToArchive(tw, container, is); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addBackupToArchive adds an LXD backup of container to tw. The backup is
+// spooled to a temporary file first, since LXD needs to seek while writing
+// it and tar needs its size up front.
+func addBackupToArchive(tw *tar.Writer, container string, is lxdclient.InstanceServer) error {
+	tmp, err := ioutil.TempFile("", "lxdk-export-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := containers.ExportContainer(container, tmp, is); err != nil {
+		return err
+	}
+
+	size, err := tmp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return addToArchive(tw, path.Join(archiveInstanceDir, container+".tar"), 0600, size, tmp)
+}
+
+func addToArchive(tw *tar.Writer, name string, mode os.FileMode, size int64, r io.Reader) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     int64(mode),
+		Size:     size,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(tw, r); err != nil {
+		return fmt.Errorf("could not add %s to archive: %w", name, err)
+	}
+
+	return nil
+}
+
+// extractArchive unpacks the archive filename into dir.
+func extractArchive(filename, dir string) error {
+	in, err := openArchive(filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("could not read %s: %w", filename, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return errors.Errorf("archive %s contains unsafe path %s", filename, hdr.Name)
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(hdr.Mode).Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return fmt.Errorf("could not extract %s: %w", hdr.Name, err)
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+}
+
+func doImport(ctx *cli.Context) error {
+	cacheDir := ctx.String("cache")
+
+	archive := ctx.Args().First()
+	if archive == "" {
+		return errors.New("must supply archive")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "lxdk-import-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	log.Default().Printf("extracting %s", archive)
+	if err := extractArchive(archive, tmpDir); err != nil {
+		return err
+	}
+
+	src, err := config.LoadClusterState(tmpDir, archiveCacheDir)
+	if err != nil {
+		return fmt.Errorf("archive has no usable cluster state: %w", err)
+	}
+	if src.Name == "" {
+		return errors.New("archive has no cluster name")
+	}
+
+	dstName := ctx.String("name")
+	if dstName == "" {
+		dstName = src.Name
+	}
+	rename := dstName != src.Name
+	if _, err := os.Stat(path.Join(cacheDir, dstName)); err == nil {
+		return errors.Errorf("cluster %s already exists at path %s", dstName, path.Join(cacheDir, dstName))
+	}
+
+	dst := src
+	dst.Name = dstName
+	dst.NetworkID = ctx.String("network")
+	dst.StoragePool = ctx.String("storage-pool")
+	dst.Remote = ctx.String("remote")
+	if dst.Remote == "" {
+		dst.Remote, err = lxd.DefaultRemote(lxdConfigPath(ctx))
+		if err != nil {
+			return err
+		}
+	}
+	dst.Project = ctx.String("project")
+	dst.RunState = config.Uninitialized
+	dst.Provisioned = false
+	// backups are made without snapshots
+	dst.Snapshots = nil
+	dst.Containers = nil
+	dst.Nodes = nil
+	dst.WorkerContainerNames = nil
+	if rename {
+		// renamed nodes lose their proxy devices, whose host ports the
+		// original cluster may still be using
+		dst.Expose = config.Expose{}
+	}
+	if dst.StorageDriver == "" {
+		dst.StorageDriver = "btrfs"
+	}
+	if len(dst.Mounts) > 0 {
+		specs := make([]string, 0, len(dst.Mounts))
+		for _, m := range dst.Mounts {
+			specs = append(specs, m.String())
+		}
+		log.Default().Printf("not importing host directories mounted into cluster %s, which may not exist on this host: %s; use --mount or lxdk mount to mount them again", src.Name, strings.Join(specs, " "))
+		dst.Mounts = nil
+	}
+
+	is, _, err := connectCluster(ctx, dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := ensureProfile(dst, is); err != nil {
+		return err
+	}
+
+	rollback, err := createNetworkAndPool(&dst, is)
+	if err != nil {
+		return err
+	}
+
+	nodes := make([]string, 0, len(src.Nodes))
+	for _, node := range src.Nodes {
+		nodes = append(nodes, node.Name)
+	}
+	addresses, err := allocateAddresses(dst, nodes, is)
+	if err != nil {
+		rollback()
+		return err
+	}
+
+	names, err := importContainers(src, dst, path.Join(tmpDir, archiveInstanceDir), rename, addresses, ctx.Int("parallelism"), is)
+	if err != nil {
+		rollback()
+		return err
+	}
+
+	for _, node := range src.Nodes {
+		name := names[node.Name]
+		switch node.Role {
+		case config.RoleEtcd:
+			dst.EtcdContainerName = name
+		case config.RoleController:
+			dst.ControllerContainerName = name
+		case config.RoleRegistry:
+			dst.RegistryContainerName = name
+		case config.RoleWorker:
+			dst.WorkerContainerNames = append(dst.WorkerContainerNames, name)
+		}
+
+		dst.Containers = append(dst.Containers, name)
+		dst.SetNode(config.Node{
+			Name:             name,
+			Role:             node.Role,
+			StaticIP:         addresses[node.Name],
+			ImageAlias:       node.ImageAlias,
+			ImageFingerprint: node.ImageFingerprint,
+		})
+	}
+
+	if err := config.SaveClusterState(cacheDir, dst); err != nil {
+		return err
+	}
+
+	for _, dir := range []string{"certificates", "kubeconfigs"} {
+		src := path.Join(tmpDir, archiveCacheDir, dir)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		if err := copyDir(src, path.Join(cacheDir, dstName, dir)); err != nil {
+			return err
+		}
+	}
+
+	// the nodes have new addresses, so start reissues their certificates
+	log.Default().Printf("imported cluster %s as %s, starting it", src.Name, dstName)
+	if err := provisionCluster(ctx, dstName, false); err != nil {
+		return err
+	}
+
+	if !rename {
+		return nil
+	}
+	return replaceKubeNodes(ctx, path.Join(cacheDir, dstName), src.Nodes, names)
+}
+
+// importContainers creates a container from the backup in backupDir of every
+// node of src, in the cluster dst, returning the name of each container by
+// the name of the node it was exported from. If any import fails the
+// containers already imported are deleted again.
+func importContainers(src, dst config.ClusterState, backupDir string, rename bool, addresses map[string]string, parallelism int, is lxdclient.InstanceServer) (map[string]string, error) {
+	var mu sync.Mutex
+	names := make(map[string]string)
+	nodes := make([]string, 0, len(src.Nodes))
+	for _, node := range src.Nodes {
+		nodes = append(nodes, node.Name)
+	}
+
+	err := forEachNode(nodes, parallelism, func(container string) error {
+		node, _ := src.Node(container)
+
+		f, err := os.Open(path.Join(backupDir, container+".tar"))
+		if err != nil {
+			return fmt.Errorf("archive has no backup of %s: %w", container, err)
+		}
+		defer f.Close()
+
+		conf := containers.ContainerConfig{
+			ImageName:   node.Role,
+			ClusterName: dst.Name,
+			StoragePool: dst.StoragePool,
+			NetworkID:   dst.NetworkID,
+			Profile:     dst.Profile,
+			IPv4:        addresses[container],
+		}
+		log.Default().Printf("importing %s", container)
+		name, err := containers.ImportContainer(f, container, rename, conf, is)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		names[container] = name
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		for _, name := range names {
+			if err := containers.DeleteContainer(name, is); err != nil {
+				log.Default().Printf("%s was not deleted: %s", name, err)
+			}
+		}
+		return nil, err
+	}
+
+	return names, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/greymatter-io/lxdk/testutils"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	for _, name := range []string{"cluster.tar", "cluster.tar.gz"} {
+		t.Run(name, func(t *testing.T) {
+			dir, cleanup, err := testutils.TempDir()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanup()
+			filename := path.Join(dir, name)
+
+			out, err := createArchive(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tw := tar.NewWriter(out)
+			data := []byte("version = 3\n")
+			if err := addToArchive(tw, "cache/state.toml", 0600, int64(len(data)), bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := out.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			extracted := path.Join(dir, "extracted")
+			if err := extractArchive(filename, extracted); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadFile(path.Join(extracted, "cache", "state.toml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("got %q, want %q", got, data)
+			}
+
+			info, err := os.Stat(path.Join(extracted, "cache", "state.toml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0600 {
+				t.Errorf("got mode %s, want 0600", info.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestExtractArchiveRefusesUnsafePaths(t *testing.T) {
+	dir, cleanup, err := testutils.TempDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	filename := path.Join(dir, "evil.tar")
+
+	out, err := createArchive(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(out)
+	if err := addToArchive(tw, "../escape", 0600, 1, bytes.NewReader([]byte("x"))); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	out.Close()
+
+	if err := extractArchive(filename, path.Join(dir, "extracted")); err == nil {
+		t.Error("expected an error for a path outside the target directory")
+	}
+}
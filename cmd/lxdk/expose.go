@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"text/tabwriter"
+
+	"github.com/greymatter-io/lxdk/config"
+	"github.com/greymatter-io/lxdk/containers"
+	lxdclient "github.com/lxc/lxd/client"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// exposeCmd publishes cluster ports on the LXD host, so the cluster can be
+// reached from other machines than the host.
+var (
+	exposeCmd = &cli.Command{
+		Name:      "expose",
+		Usage:     "publish the API server or NodePorts of a cluster on the LXD host, or list what is published",
+		ArgsUsage: "<cluster name>",
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:  "api-port",
+				Usage: "host port to publish the Kubernetes API server on",
+			},
+			&cli.StringSliceFlag{
+				Name:  "nodeport",
+				Usage: "NodePort to publish from the first worker, as nodeport[:host port], e.g. 30080:8080",
+			},
+			&cli.StringFlag{
+				Name:  "address",
+				Usage: "host address to listen on",
+				Value: config.DefaultExposeAddress,
+			},
+			&cli.StringSliceFlag{
+				Name:  "host",
+				Usage: "name or address clients reach the host by, added to the API server certificate and used in client.kubeconfig",
+			},
+		},
+		Action: doExpose,
+	}
+
+	unexposeCmd = &cli.Command{
+		Name:      "unexpose",
+		Usage:     "stop publishing ports of a cluster on the LXD host, every port unless some are given",
+		ArgsUsage: "<cluster name>",
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "api",
+				Usage: "stop publishing the Kubernetes API server",
+			},
+			&cli.IntSliceFlag{
+				Name:  "nodeport",
+				Usage: "NodePort to stop publishing",
+			},
+		},
+		Action: doUnexpose,
+	}
+)
+
+func doExpose(ctx *cli.Context) error {
+	state, err := config.ClusterStateFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	if ctx.NumFlags() == 0 {
+		return listExposed(state)
+	}
+
+	expose := state.Expose
+	if ctx.IsSet("address") || expose.Address == "" {
+		expose.Address = ctx.String("address")
+	}
+	for _, host := range ctx.StringSlice("host") {
+		if !containsHost(expose.Hosts, host) {
+			expose.Hosts = append(expose.Hosts, host)
+		}
+	}
+	if ctx.IsSet("api-port") {
+		expose.APIPort = ctx.Int("api-port")
+	}
+	for _, spec := range ctx.StringSlice("nodeport") {
+		np, err := config.ParseNodePort(spec)
+		if err != nil {
+			return err
+		}
+		expose.SetNodePort(np)
+	}
+	if len(expose.NodePorts) > 0 && len(state.WorkerContainerNames) == 0 {
+		return errors.Errorf("cluster %s has no workers to publish NodePorts from", state.Name)
+	}
+
+	is, hostname, err := connectCluster(ctx, state)
+	if err != nil {
+		return err
+	}
+
+	apiChanged := expose.APIPort != state.Expose.APIPort ||
+		expose.APIPort != 0 && (expose.Address != state.Expose.Address || len(expose.Hosts) != len(state.Expose.Hosts))
+	state.Expose = expose
+
+	if expose.APIPort != 0 {
+		log.Default().Printf("publishing the API server on %s:%d", expose.ListenAddress(), expose.APIPort)
+		err := containers.AddProxyDevice(state.ControllerContainerName, containers.APIProxyDevice, expose.ListenAddress(), expose.APIPort, 6443, is)
+		if err != nil {
+			return err
+		}
+	}
+	for _, np := range expose.NodePorts {
+		log.Default().Printf("publishing NodePort %d on %s:%d", np.NodePort, expose.ListenAddress(), np.HostPort)
+		err := containers.AddProxyDevice(state.WorkerContainerNames[0], containers.NodePortProxyDevice(np.NodePort), expose.ListenAddress(), np.HostPort, np.NodePort, is)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := config.WriteClusterState(ctx, state); err != nil {
+		return err
+	}
+
+	if apiChanged {
+		return refreshAPIEndpoint(ctx, state, hostname, is)
+	}
+
+	return nil
+}
+
+func doUnexpose(ctx *cli.Context) error {
+	state, err := config.ClusterStateFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	all := !ctx.Bool("api") && len(ctx.IntSlice("nodeport")) == 0
+	nodePorts := ctx.IntSlice("nodeport")
+	if all {
+		for _, np := range state.Expose.NodePorts {
+			nodePorts = append(nodePorts, np.NodePort)
+		}
+	}
+
+	is, hostname, err := connectCluster(ctx, state)
+	if err != nil {
+		return err
+	}
+
+	for _, nodePort := range nodePorts {
+		if !state.Expose.RemoveNodePort(nodePort) {
+			return errors.Errorf("NodePort %d of cluster %s is not published", nodePort, state.Name)
+		}
+		if len(state.WorkerContainerNames) == 0 {
+			continue
+		}
+
+		log.Default().Printf("unpublishing NodePort %d", nodePort)
+		err := containers.RemoveDevice(state.WorkerContainerNames[0], containers.NodePortProxyDevice(nodePort), is)
+		if err != nil {
+			return err
+		}
+	}
+
+	apiChanged := false
+	if (all || ctx.Bool("api")) && state.Expose.APIPort != 0 {
+		log.Default().Println("unpublishing the API server")
+		err := containers.RemoveDevice(state.ControllerContainerName, containers.APIProxyDevice, is)
+		if err != nil {
+			return err
+		}
+		state.Expose.APIPort = 0
+		apiChanged = true
+	}
+
+	if err := config.WriteClusterState(ctx, state); err != nil {
+		return err
+	}
+
+	if apiChanged {
+		return refreshAPIEndpoint(ctx, state, hostname, is)
+	}
+
+	return nil
+}
+
+// refreshAPIEndpoint reissues the API server certificate of a running
+// cluster for the names its API server is now reached by, and points
+// client.kubeconfig at it. A cluster that isn't running gets both when it
+// is next started.
+func refreshAPIEndpoint(ctx *cli.Context, state config.ClusterState, hostname string, is lxdclient.InstanceServer) error {
+	if state.RunState != config.Running {
+		log.Default().Printf("cluster %s is not running, the API server certificate and client.kubeconfig are updated when it starts", state.Name)
+		return nil
+	}
+
+	controller, _ := state.Node(state.ControllerContainerName)
+	if controller.IP == "" {
+		return errors.Errorf("the address of controller %s is not known, restart cluster %s to update its API server certificate", state.ControllerContainerName, state.Name)
+	}
+
+	clusterDir := path.Join(ctx.String("cache"), state.Name)
+	certDir := path.Join(clusterDir, "certificates")
+
+	log.Default().Println("reissuing the API server certificate")
+	if err := createAPIServerCert(state, certDir, controller.IP, hostname); err != nil {
+		return err
+	}
+
+	err := containers.UploadFiles([]string{
+		path.Join(certDir, "kubernetes.pem"),
+		path.Join(certDir, "kubernetes-key.pem"),
+	}, "/etc/kubernetes/", state.ControllerContainerName, is)
+	if err != nil {
+		return err
+	}
+
+	err = containers.RunCommand(ctx.Context, state.ControllerContainerName, "systemctl restart kube-apiserver", is)
+	if err != nil {
+		return err
+	}
+
+	return createClientKubeconfig(clusterDir, clientServer(state, controller.IP, hostname, false))
+}
+
+func listExposed(state config.ClusterState) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintln(w, "NAME\tHOST ADDRESS\tNODE\tPORT")
+
+	address := state.Expose.ListenAddress()
+	if state.Expose.APIPort != 0 {
+		fmt.Fprintf(w, "api\t%s:%d\t%s\t6443\n", address, state.Expose.APIPort, state.ControllerContainerName)
+	}
+	if len(state.WorkerContainerNames) > 0 {
+		for _, np := range state.Expose.NodePorts {
+			fmt.Fprintf(w, "nodeport\t%s:%d\t%s\t%d\n", address, np.HostPort, state.WorkerContainerNames[0], np.NodePort)
+		}
+	}
+
+	return w.Flush()
+}
+
+func containsHost(hosts []string, host string) bool {
+	for _, h := range hosts {
+		if h == host {
+			return true
+		}
+	}
+
+	return false
+}
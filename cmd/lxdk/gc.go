@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/greymatter-io/lxdk/config"
+	"github.com/greymatter-io/lxdk/containers"
+	lxdclient "github.com/lxc/lxd/client"
+	"github.com/lxc/lxd/shared/api"
+	"github.com/urfave/cli/v2"
+)
+
+// gcCmd finds LXD resources created by lxdk that no cluster in the cache
+// refers to, usually left behind by failed creates or deleted cache
+// directories, and deletes them. Resources that aren't tagged with a cluster,
+// made by lxdk versions before tagging or by another machine sharing the LXD
+// server, are only included when asked for.
+var gcCmd = &cli.Command{
+	Name:  "gc",
+	Usage: "find and delete LXD resources lxdk created that no cluster in the cache uses, including those of creates that failed before the cluster was saved",
+	Flags: append([]cli.Flag{
+		&cli.BoolFlag{
+			Name:    "yes",
+			Aliases: []string{"y"},
+			Usage:   "delete without asking for confirmation",
+		},
+		&cli.BoolFlag{
+			Name:  "include-foreign",
+			Usage: "also delete untagged resources named like lxdk's, which older lxdk versions or another machine may have created",
+		},
+	}, remoteFlags...),
+	Action: doGC,
+}
+
+// orphan is an LXD resource created by lxdk that no cluster refers to.
+type orphan struct {
+	Kind    string
+	Name    string
+	Cluster string
+}
+
+// references is everything the clusters in the cache refer to.
+type references struct {
+	// clusters whose state could not be read; anything tagged as
+	// belonging to them is kept
+	unreadable map[string]bool
+	instances  map[string]bool
+	networks   map[string]bool
+	pools      map[string]bool
+}
+
+func doGC(ctx *cli.Context) error {
+	refs, err := cacheReferences(ctx.String("cache"))
+	if err != nil {
+		return err
+	}
+
+	is, _, err := connectFlags(ctx)
+	if err != nil {
+		return err
+	}
+
+	orphans, err := findOrphans(refs, ctx.Bool("include-foreign"), is)
+	if err != nil {
+		return err
+	}
+
+	if len(orphans) == 0 {
+		fmt.Println("no orphaned resources found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tNAME\tCLUSTER")
+	for _, o := range orphans {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", o.Kind, o.Name, o.Cluster)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if !ctx.Bool("yes") {
+		fmt.Printf("delete %d resources? [y/N] ", len(orphans))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			fmt.Println("nothing deleted")
+			return nil
+		}
+	}
+
+	var failed int
+	for _, o := range orphans {
+		if err := deleteOrphan(o, is); err != nil {
+			log.Default().Printf("could not delete %s %s: %s", o.Kind, o.Name, err)
+			failed++
+			continue
+		}
+		log.Default().Printf("deleted %s %s", o.Kind, o.Name)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d resources could not be deleted", failed)
+	}
+
+	return nil
+}
+
+// cacheReferences collects the resources referred to by every cluster in
+// cacheDir.
+func cacheReferences(cacheDir string) (references, error) {
+	refs := references{
+		unreadable: make(map[string]bool),
+		instances:  make(map[string]bool),
+		networks:   make(map[string]bool),
+		pools:      make(map[string]bool),
+	}
+
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil && !os.IsNotExist(err) {
+		return refs, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		state, err := config.LoadClusterState(cacheDir, entry.Name())
+		if err != nil {
+			log.Default().Printf("keeping all resources of cluster %s, its state could not be read: %s", entry.Name(), err)
+			refs.unreadable[entry.Name()] = true
+			continue
+		}
+
+		for _, name := range state.Containers {
+			refs.instances[name] = true
+		}
+		refs.networks[state.NetworkID] = true
+		refs.pools[state.StoragePool] = true
+	}
+
+	return refs, nil
+}
+
+// findOrphans lists the lxdk resources on the LXD server that refs doesn't
+// account for, in the order they have to be deleted. Unless includeForeign is
+// true, resources that aren't tagged with a cluster are left out.
+func findOrphans(refs references, includeForeign bool, is lxdclient.InstanceServer) ([]orphan, error) {
+	var orphans []orphan
+	var foreign int
+	isForeign := func(cluster string) bool {
+		if includeForeign || cluster != "" {
+			return false
+		}
+		foreign++
+		return true
+	}
+
+	instances, err := is.GetInstances(api.InstanceTypeAny)
+	if err != nil {
+		return nil, err
+	}
+
+	// instances that stay, and so keep their profiles, networks and
+	// pools in use
+	kept := make(map[string]bool)
+	for _, in := range instances {
+		cluster := in.Config[containers.MetadataCluster]
+		if !isLXDKResource(in.Name, cluster) || refs.instances[in.Name] || refs.unreadable[cluster] || isForeign(cluster) {
+			kept[in.Name] = true
+			continue
+		}
+		orphans = append(orphans, orphan{Kind: "instance", Name: in.Name, Cluster: cluster})
+	}
+
+	profiles, err := is.GetProfiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, prof := range profiles {
+		if !isLXDKProfile(prof.Name) || usedByKept(prof.UsedBy, kept) {
+			continue
+		}
+		orphans = append(orphans, orphan{Kind: "profile", Name: prof.Name})
+	}
+
+	networks, err := is.GetNetworks()
+	if err != nil {
+		return nil, err
+	}
+	for _, net := range networks {
+		cluster := net.Config[containers.MetadataCluster]
+		if !net.Managed || !isLXDKResource(net.Name, cluster) || refs.networks[net.Name] || refs.unreadable[cluster] {
+			continue
+		}
+		if isForeign(cluster) || usedByKept(net.UsedBy, kept) {
+			continue
+		}
+		orphans = append(orphans, orphan{Kind: "network", Name: net.Name, Cluster: cluster})
+	}
+
+	pools, err := is.GetStoragePools()
+	if err != nil {
+		return nil, err
+	}
+	for _, pool := range pools {
+		cluster := pool.Config[containers.MetadataCluster]
+		if !isLXDKResource(pool.Name, cluster) || refs.pools[pool.Name] || refs.unreadable[cluster] {
+			continue
+		}
+		if isForeign(cluster) || usedByKept(pool.UsedBy, kept) {
+			continue
+		}
+		orphans = append(orphans, orphan{Kind: "storage pool", Name: pool.Name, Cluster: cluster})
+	}
+
+	if foreign > 0 {
+		log.Default().Printf("skipping %d untagged resources, use --include-foreign to include them", foreign)
+	}
+
+	return orphans, nil
+}
+
+// isLXDKResource returns true if a resource was tagged by lxdk or, for
+// resources created before tagging, follows lxdk's naming scheme.
+func isLXDKResource(name, cluster string) bool {
+	return cluster != "" || strings.HasPrefix(name, "lxdk-")
+}
+
+func isLXDKProfile(name string) bool {
+	return name == "lxdk" || strings.HasPrefix(name, "lxdk-")
+}
+
+// usedByKept returns true if any of the API URLs in usedBy refers to an
+// instance that is being kept.
+func usedByKept(usedBy []string, kept map[string]bool) bool {
+	for _, url := range usedBy {
+		url = strings.SplitN(url, "?", 2)[0]
+		for _, prefix := range []string{"/1.0/instances/", "/1.0/containers/", "/1.0/virtual-machines/"} {
+			if strings.HasPrefix(url, prefix) && kept[strings.TrimPrefix(url, prefix)] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func deleteOrphan(o orphan, is lxdclient.InstanceServer) error {
+	switch o.Kind {
+	case "instance":
+		return containers.DeleteContainer(o.Name, is)
+	case "profile":
+		return deleteProfile(o.Name, is)
+	case "network":
+		return is.DeleteNetwork(o.Name)
+	case "storage pool":
+		return is.DeleteStoragePool(o.Name)
+	}
+
+	return fmt.Errorf("unknown resource type %s", o.Kind)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/greymatter-io/lxdk/containers"
+	lxdclient "github.com/lxc/lxd/client"
+	"github.com/lxc/lxd/shared/api"
+)
+
+// fakeGCServer lists a fixed set of resources, and reports the state of
+// instances from states. Instances missing from states don't exist.
+type fakeGCServer struct {
+	lxdclient.InstanceServer
+	instances []api.Instance
+	networks  []api.Network
+	states    map[string]api.StatusCode
+}
+
+func (s *fakeGCServer) GetInstanceState(name string) (*api.InstanceState, string, error) {
+	code, ok := s.states[name]
+	if !ok {
+		return nil, "", api.StatusErrorf(http.StatusNotFound, "Instance not found")
+	}
+
+	return &api.InstanceState{StatusCode: code}, "", nil
+}
+
+func (s *fakeGCServer) GetInstances(instanceType api.InstanceType) ([]api.Instance, error) {
+	return s.instances, nil
+}
+
+func (s *fakeGCServer) GetProfiles() ([]api.Profile, error) {
+	return nil, nil
+}
+
+func (s *fakeGCServer) GetNetworks() ([]api.Network, error) {
+	return s.networks, nil
+}
+
+func (s *fakeGCServer) GetStoragePools() ([]api.StoragePool, error) {
+	return nil, nil
+}
+
+// TestFindOrphansUntagged checks that resources of clusters missing from the
+// cache are collected by default, and untagged ones only when asked for.
+func TestFindOrphansUntagged(t *testing.T) {
+	tagged := func(cluster string) map[string]string {
+		return map[string]string{containers.MetadataCluster: cluster}
+	}
+	is := &fakeGCServer{
+		instances: []api.Instance{
+			{Name: "lxdk-mine-worker-abcde", InstancePut: api.InstancePut{Config: tagged("mine")}},
+			{Name: "lxdk-failed-etcd-abcde", InstancePut: api.InstancePut{Config: tagged("failed")}},
+			{Name: "lxdk-old-etcd-abcde"},
+		},
+		networks: []api.Network{
+			{Name: "lxdk-failed", Managed: true, NetworkPut: api.NetworkPut{Config: tagged("failed")}, UsedBy: []string{"/1.0/instances/lxdk-failed-etcd-abcde"}},
+			{Name: "lxdk-old", Managed: true, UsedBy: []string{"/1.0/instances/lxdk-old-etcd-abcde"}},
+		},
+	}
+	refs := references{
+		unreadable: map[string]bool{},
+		instances:  map[string]bool{"lxdk-mine-worker-abcde": true},
+		networks:   map[string]bool{},
+		pools:      map[string]bool{},
+	}
+
+	got, err := findOrphans(refs, false, is)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []orphan{
+		{Kind: "instance", Name: "lxdk-failed-etcd-abcde", Cluster: "failed"},
+		{Kind: "network", Name: "lxdk-failed", Cluster: "failed"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("findOrphans = %+v, want %+v", got, want)
+	}
+
+	got, err = findOrphans(refs, true, is)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []orphan{
+		{Kind: "instance", Name: "lxdk-failed-etcd-abcde", Cluster: "failed"},
+		{Kind: "instance", Name: "lxdk-old-etcd-abcde"},
+		{Kind: "network", Name: "lxdk-failed", Cluster: "failed"},
+		{Kind: "network", Name: "lxdk-old"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("findOrphans with untagged resources = %+v, want %+v", got, want)
+	}
+}
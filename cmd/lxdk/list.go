@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"os"
+	"text/tabwriter"
 
+	"github.com/greymatter-io/lxdk/config"
 	"github.com/urfave/cli/v2"
 )
 
@@ -22,14 +24,27 @@ func doList(ctx *cli.Context) error {
 		return err
 	}
 
-	var clusters []string
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATE\tNODES\tKUBERNETES\tCREATED")
 	for _, entry := range dirEntries {
-		if entry.IsDir() {
-			clusters = append(clusters, entry.Name())
+		if !entry.IsDir() {
+			continue
+		}
+
+		state, err := config.LoadClusterState(cacheDir, entry.Name())
+		if err != nil {
+			fmt.Fprintf(w, "%s\tunknown (%s)\t\t\t\n", entry.Name(), err)
+			continue
 		}
-	}
 
-	fmt.Println(clusters)
+		created := ""
+		if !state.CreatedAt.IsZero() {
+			created = state.CreatedAt.Local().Format("2006-01-02 15:04")
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n",
+			entry.Name(), state.RunState, len(state.Containers), state.KubernetesVersion, created)
+	}
 
-	return nil
+	return w.Flush()
 }
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/greymatter-io/lxdk/config"
+	"github.com/greymatter-io/lxdk/containers"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// logsCmd shows the journal of the systemd units lxdk runs on the nodes of
+// a cluster, merged into one stream ordered by time.
+var logsCmd = &cli.Command{
+	Name:      "logs",
+	Usage:     "show logs of the Kubernetes services running on a cluster",
+	ArgsUsage: "<cluster name>",
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:    "node",
+			Aliases: []string{"n"},
+			Usage:   "node to show logs of: etcd, controller, registry, worker, worker-<n>, all or a container name; may be repeated",
+			Value:   cli.NewStringSlice("all"),
+		},
+		&cli.StringSliceFlag{
+			Name:    "unit",
+			Aliases: []string{"u"},
+			Usage:   "systemd unit to show logs of, for example kubelet; may be repeated",
+		},
+		&cli.BoolFlag{
+			Name:    "follow",
+			Aliases: []string{"f"},
+			Usage:   "keep printing new log entries as they are written",
+		},
+		&cli.StringFlag{
+			Name:  "since",
+			Usage: "only show entries newer than this, either a duration such as 10m or a time journalctl understands",
+		},
+	},
+	Action: doLogs,
+}
+
+// roleUnits are the systemd units lxdk runs on each role. The controller is
+// also set up as a worker.
+var roleUnits = map[string][]string{
+	config.RoleEtcd:       {"etcd"},
+	config.RoleController: {"kube-apiserver", "kube-controller-manager", "kube-scheduler", "crio", "kubelet", "kube-proxy"},
+	config.RoleWorker:     {"crio", "kubelet", "kube-proxy"},
+	config.RoleRegistry:   {"oci-registry"},
+}
+
+// mergeWindow is how long entries are held back when following, so entries
+// from nodes whose output arrives a little later are still printed in order.
+const mergeWindow = time.Second
+
+// logEntry is a journal entry from a node.
+type logEntry struct {
+	Time    time.Time
+	Node    string
+	Unit    string
+	Message string
+}
+
+func doLogs(ctx *cli.Context) error {
+	state, err := config.ClusterStateFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	nodes, err := selectNodes(state, ctx.StringSlice("node"))
+	if err != nil {
+		return err
+	}
+
+	nodeUnits, err := unitsByNode(state, nodes, ctx.StringSlice("unit"))
+	if err != nil {
+		return err
+	}
+
+	is, _, err := connectCluster(ctx, state)
+	if err != nil {
+		return err
+	}
+
+	follow := ctx.Bool("follow")
+	since := journalSince(ctx.String("since"))
+
+	merger := newLogMerger(os.Stdout)
+	if follow {
+		go merger.run(mergeWindow)
+	}
+
+	names := make([]string, 0, len(nodeUnits))
+	for _, node := range nodes {
+		if len(nodeUnits[node]) > 0 {
+			names = append(names, node)
+		}
+	}
+
+	parallelism := ctx.Int("parallelism")
+	if follow {
+		// every journal has to be read at once for the streams to merge
+		parallelism = len(names)
+	}
+
+	err = forEachNode(names, parallelism, func(node string) error {
+		command := []string{"journalctl", "--no-pager", "--output", "json"}
+		for _, unit := range nodeUnits[node] {
+			command = append(command, "--unit", unit)
+		}
+		if since != "" {
+			command = append(command, "--since", since)
+		}
+		if follow {
+			command = append(command, "--follow")
+		}
+
+		pr, pw := io.Pipe()
+		parsed := make(chan error, 1)
+		go func() {
+			parsed <- readJournal(node, pr, merger.add)
+		}()
+
+		_, err := containers.ExecContext(ctx.Context, node, containers.ExecOptions{
+			Command: command,
+			Stdout:  pw,
+		}, is)
+		pw.Close()
+		if perr := <-parsed; err == nil {
+			err = perr
+		}
+
+		return err
+	})
+
+	merger.flush(time.Time{})
+
+	// following ends with an interrupt
+	if follow && ctx.Context.Err() != nil {
+		return nil
+	}
+
+	return err
+}
+
+// unitsByNode returns the units to read the journal of on each node,
+// limited to units if any are given.
+func unitsByNode(state config.ClusterState, nodes, units []string) (map[string][]string, error) {
+	wanted := make(map[string]bool)
+	for _, unit := range units {
+		wanted[unit] = true
+	}
+
+	nodeUnits := make(map[string][]string)
+	found := make(map[string]bool)
+	for _, name := range nodes {
+		node, ok := state.Node(name)
+		if !ok {
+			return nil, errors.Errorf("node %s is not in the cluster state", name)
+		}
+
+		for _, unit := range roleUnits[node.Role] {
+			if len(wanted) > 0 && !wanted[unit] {
+				continue
+			}
+			found[unit] = true
+			nodeUnits[name] = append(nodeUnits[name], unit)
+		}
+	}
+
+	for _, unit := range units {
+		if !found[unit] {
+			return nil, errors.Errorf("no selected node runs %s", unit)
+		}
+	}
+
+	return nodeUnits, nil
+}
+
+// journalSince turns a duration such as 10m into a time relative to now that
+// journalctl understands, and passes anything else through.
+func journalSince(since string) string {
+	if d, err := time.ParseDuration(since); err == nil {
+		return fmt.Sprintf("-%ds", int(d.Seconds()))
+	}
+
+	return since
+}
+
+// readJournal parses the JSON lines journalctl writes to r and passes each
+// entry to add.
+func readJournal(node string, r io.Reader, add func(logEntry)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry, err := parseJournalEntry(node, scanner.Bytes())
+		if err != nil {
+			continue
+		}
+		add(entry)
+	}
+
+	// drain the rest so the writer isn't blocked if a line was too long
+	io.Copy(io.Discard, r)
+
+	return scanner.Err()
+}
+
+// parseJournalEntry parses one line of journalctl --output json.
+func parseJournalEntry(node string, line []byte) (logEntry, error) {
+	var fields struct {
+		Timestamp string          `json:"__REALTIME_TIMESTAMP"`
+		Unit      string          `json:"_SYSTEMD_UNIT"`
+		Message   json.RawMessage `json:"MESSAGE"`
+	}
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return logEntry{}, err
+	}
+
+	usec, err := strconv.ParseInt(fields.Timestamp, 10, 64)
+	if err != nil {
+		return logEntry{}, fmt.Errorf("bad timestamp %q: %w", fields.Timestamp, err)
+	}
+
+	// journald encodes messages that aren't valid UTF-8 as arrays of bytes
+	var message string
+	if err := json.Unmarshal(fields.Message, &message); err != nil {
+		var raw []byte
+		var ints []int
+		if json.Unmarshal(fields.Message, &ints) == nil {
+			for _, b := range ints {
+				raw = append(raw, byte(b))
+			}
+		}
+		message = string(raw)
+	}
+
+	return logEntry{
+		Time:    time.Unix(0, usec*int64(time.Microsecond)),
+		Node:    node,
+		Unit:    strings.TrimSuffix(fields.Unit, ".service"),
+		Message: message,
+	}, nil
+}
+
+// logMerger collects entries from several nodes and prints them in time
+// order.
+type logMerger struct {
+	mu      sync.Mutex
+	w       io.Writer
+	pending []logEntry
+}
+
+func newLogMerger(w io.Writer) *logMerger {
+	return &logMerger{w: w}
+}
+
+func (m *logMerger) add(entry logEntry) {
+	m.mu.Lock()
+	m.pending = append(m.pending, entry)
+	m.mu.Unlock()
+}
+
+// run prints entries older than window every window, forever.
+func (m *logMerger) run(window time.Duration) {
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		m.flush(now.Add(-window))
+	}
+}
+
+// flush prints the pending entries written before cutoff, or all of them if
+// cutoff is zero.
+func (m *logMerger) flush(cutoff time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sort.SliceStable(m.pending, func(i, j int) bool {
+		return m.pending[i].Time.Before(m.pending[j].Time)
+	})
+
+	n := len(m.pending)
+	if !cutoff.IsZero() {
+		n = sort.Search(len(m.pending), func(i int) bool {
+			return m.pending[i].Time.After(cutoff)
+		})
+	}
+
+	for _, entry := range m.pending[:n] {
+		fmt.Fprintf(m.w, "%s [%s] %s: %s\n", entry.Time.Format("Jan _2 15:04:05.000"), entry.Node, entry.Unit, entry.Message)
+	}
+	m.pending = append(m.pending[:0], m.pending[n:]...)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestParseJournalEntry(t *testing.T) {
+	line := []byte(`{"__REALTIME_TIMESTAMP":"1650000000123456","_SYSTEMD_UNIT":"kubelet.service","MESSAGE":"started"}`)
+	entry, err := parseJournalEntry("worker", line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Unit != "kubelet" || entry.Message != "started" || entry.Node != "worker" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	if want := time.Unix(1650000000, 123456000); !entry.Time.Equal(want) {
+		t.Errorf("got time %s, want %s", entry.Time, want)
+	}
+
+	binary := []byte(`{"__REALTIME_TIMESTAMP":"1","_SYSTEMD_UNIT":"crio.service","MESSAGE":[104,105]}`)
+	entry, err = parseJournalEntry("worker", binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Message != "hi" {
+		t.Errorf("got message %q, want %q", entry.Message, "hi")
+	}
+}
+
+func TestLogMergerOrdersEntries(t *testing.T) {
+	var out bytes.Buffer
+	m := newLogMerger(&out)
+	base := time.Date(2022, 4, 1, 10, 0, 0, 0, time.UTC)
+	m.add(logEntry{Time: base.Add(2 * time.Second), Node: "b", Unit: "kubelet", Message: "third"})
+	m.add(logEntry{Time: base, Node: "a", Unit: "etcd", Message: "first"})
+	m.add(logEntry{Time: base.Add(time.Second), Node: "b", Unit: "kubelet", Message: "second"})
+
+	m.flush(base.Add(time.Second))
+	first := out.String()
+	m.flush(time.Time{})
+
+	if !bytes.Contains([]byte(first), []byte("second")) || bytes.Contains([]byte(first), []byte("third")) {
+		t.Errorf("cutoff flush printed %q", first)
+	}
+
+	want := []string{"first", "second", "third"}
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(lines), len(want))
+	}
+	for i, line := range lines {
+		if !bytes.HasSuffix(line, []byte(want[i])) {
+			t.Errorf("line %d is %q, want it to end in %q", i, line, want[i])
+		}
+	}
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/greymatter-io/lxdk/version"
 	"github.com/urfave/cli/v2" // imports as package "cli"
@@ -34,6 +38,30 @@ var app = &cli.App{
 			Value:   fmt.Sprintf("%s/.config/lxc/config.yml", os.Getenv("HOME")),
 			EnvVars: []string{"LXDK_LXD_CONFIG"},
 		},
+		&cli.IntFlag{
+			Name:    "parallelism",
+			Usage:   "maximum number of nodes to operate on at once",
+			Value:   4,
+			EnvVars: []string{"LXDK_PARALLELISM"},
+		},
+		&cli.DurationFlag{
+			Name:    "ip-timeout",
+			Usage:   "how long to wait for a node to get an IP address",
+			Value:   100 * time.Second,
+			EnvVars: []string{"LXDK_IP_TIMEOUT"},
+		},
+		&cli.DurationFlag{
+			Name:    "api-timeout",
+			Usage:   "how long to wait for the Kubernetes API server to become ready",
+			Value:   150 * time.Second,
+			EnvVars: []string{"LXDK_API_TIMEOUT"},
+		},
+		&cli.DurationFlag{
+			Name:    "node-timeout",
+			Usage:   "how long to wait for a Kubernetes node to register",
+			Value:   150 * time.Second,
+			EnvVars: []string{"LXDK_NODE_TIMEOUT"},
+		},
 	},
 	Commands: []*cli.Command{
 		upCmd,
@@ -46,6 +74,20 @@ var app = &cli.App{
 		createCmd,
 		debugCertCmd,
 		stopCmd,
+		adoptCmd,
+		gcCmd,
+		shellCmd,
+		execCmd,
+		logsCmd,
+		cpCmd,
+		snapshotCmd,
+		cloneCmd,
+		exportCmd,
+		importCmd,
+		mountCmd,
+		unmountCmd,
+		exposeCmd,
+		unexposeCmd,
 	},
 	CommandNotFound: func(c *cli.Context, cmd string) {
 		fmt.Fprintf(c.App.Writer, `command not found: %s, run "lxdk --help" for help`, cmd)
@@ -53,7 +95,15 @@ var app = &cli.App{
 }
 
 func main() {
-	err := app.Run(os.Args)
+	// the first interrupt cancels what lxdk is doing, so it can roll back
+	// or record the state it leaves the cluster in; a second one kills it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	err := app.RunContext(ctx, os.Args)
 	if err != nil {
 		log.Fatal(err)
 	}
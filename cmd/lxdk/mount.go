@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/greymatter-io/lxdk/config"
+	"github.com/greymatter-io/lxdk/containers"
+	lxdclient "github.com/lxc/lxd/client"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// mountFlag mounts host directories into the workers of a cluster, shared
+// by create and start.
+var mountFlag = &cli.StringSliceFlag{
+	Name:  "mount",
+	Usage: "mount a directory of the LXD host into every worker, as source:path[:ro,controller], e.g. /home/me/src:/src",
+}
+
+var (
+	mountCmd = &cli.Command{
+		Name:      "mount",
+		Usage:     "mount a host directory into the nodes of a cluster, or list its mounts",
+		ArgsUsage: "<cluster name> [source:path[:ro,controller]]",
+		Action:    doMount,
+	}
+
+	unmountCmd = &cli.Command{
+		Name:      "unmount",
+		Usage:     "remove a host directory mounted into the nodes of a cluster",
+		ArgsUsage: "<cluster name> <path>",
+		Action:    doUnmount,
+	}
+)
+
+func doMount(ctx *cli.Context) error {
+	state, err := config.ClusterStateFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	if ctx.Args().Len() < 2 {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+		fmt.Fprintln(w, "SOURCE\tPATH\tREAD ONLY\tCONTROLLER")
+		for _, m := range state.Mounts {
+			fmt.Fprintf(w, "%s\t%s\t%t\t%t\n", m.Source, m.Path, m.ReadOnly, m.Controller)
+		}
+		return w.Flush()
+	}
+
+	m, err := config.ParseMount(ctx.Args().Get(1))
+	if err != nil {
+		return err
+	}
+
+	is, _, err := connectCluster(ctx, state)
+	if err != nil {
+		return err
+	}
+
+	// a mount moved off the controller must be removed from it
+	for _, old := range state.Mounts {
+		if old.Path == m.Path && old.Controller && !m.Controller {
+			if err := containers.RemoveDiskMount(state.ControllerContainerName, m.Path, is); err != nil {
+				return err
+			}
+		}
+	}
+
+	state.SetMount(m)
+	if err := applyMounts(state, []config.Mount{m}, is); err != nil {
+		return err
+	}
+
+	return config.WriteClusterState(ctx, state)
+}
+
+func doUnmount(ctx *cli.Context) error {
+	state, err := config.ClusterStateFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	if ctx.Args().Len() < 2 {
+		return errors.New("must supply the path to unmount")
+	}
+
+	m, ok := state.RemoveMount(ctx.Args().Get(1))
+	if !ok {
+		return errors.Errorf("cluster %s has nothing mounted at %s", state.Name, ctx.Args().Get(1))
+	}
+
+	is, _, err := connectCluster(ctx, state)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range state.MountNodes(m) {
+		log.Default().Printf("unmounting %s from %s", m.Path, node)
+		if err := containers.RemoveDiskMount(node, m.Path, is); err != nil {
+			return err
+		}
+	}
+
+	return config.WriteClusterState(ctx, state)
+}
+
+// mountFlags parses the mounts given with mountFlag.
+func mountFlags(ctx *cli.Context) ([]config.Mount, error) {
+	var mounts []config.Mount
+	for _, spec := range ctx.StringSlice(mountFlag.Name) {
+		m, err := config.ParseMount(spec)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, m)
+	}
+
+	return mounts, nil
+}
+
+// applyMounts adds mounts to the nodes of state they belong on. Disk devices
+// can be added to running containers, so the nodes don't need restarting.
+func applyMounts(state config.ClusterState, mounts []config.Mount, is lxdclient.InstanceServer) error {
+	for _, m := range mounts {
+		for _, node := range state.MountNodes(m) {
+			log.Default().Printf("mounting %s at %s on %s", m.Source, m.Path, node)
+			if err := containers.AddDiskMount(node, m.Source, m.Path, m.ReadOnly, is); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
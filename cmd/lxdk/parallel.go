@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// nodeErrors holds the errors of an operation run on several nodes, keyed by
+// node.
+type nodeErrors map[string]error
+
+func (e nodeErrors) Error() string {
+	nodes := make([]string, 0, len(e))
+	for node := range e {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	msgs := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", node, e[node]))
+	}
+
+	if len(msgs) == 1 {
+		return msgs[0]
+	}
+	return fmt.Sprintf("%d nodes failed:\n  %s", len(msgs), strings.Join(msgs, "\n  "))
+}
+
+// forEachNode calls fn for every node, running at most parallelism calls at
+// once. Every node is attempted even if some fail; the failures are returned
+// as a nodeErrors.
+func forEachNode(nodes []string, parallelism int, fn func(node string) error) error {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs = make(nodeErrors)
+		sem  = make(chan struct{}, parallelism)
+	)
+	for _, node := range nodes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(node string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := fn(node); err != nil {
+				mu.Lock()
+				errs[node] = err
+				mu.Unlock()
+			}
+		}(node)
+	}
+	wg.Wait()
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestForEachNodeBounded checks that forEachNode runs every node and never
+// more than parallelism at once.
+func TestForEachNodeBounded(t *testing.T) {
+	nodes := []string{"a", "b", "c", "d", "e", "f", "g"}
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	seen := make(map[string]bool)
+
+	err := forEachNode(nodes, 3, func(node string) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		seen[node] = true
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if maxRunning > 3 {
+		t.Fatalf("ran %d nodes at once, expected at most 3", maxRunning)
+	}
+	if len(seen) != len(nodes) {
+		t.Fatalf("ran %d nodes, expected %d", len(seen), len(nodes))
+	}
+}
+
+// TestForEachNodeCollectsErrors checks that a failing node doesn't stop the
+// others and that every failure is reported against its node.
+func TestForEachNodeCollectsErrors(t *testing.T) {
+	var mu sync.Mutex
+	ran := 0
+
+	err := forEachNode([]string{"a", "b", "c"}, 2, func(node string) error {
+		mu.Lock()
+		ran++
+		mu.Unlock()
+
+		if node == "a" || node == "c" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+
+	if ran != 3 {
+		t.Fatalf("ran %d nodes, expected 3", ran)
+	}
+
+	errs, ok := err.(nodeErrors)
+	if !ok {
+		t.Fatalf("expected nodeErrors, got %T", err)
+	}
+	if len(errs) != 2 || errs["a"] == nil || errs["c"] == nil {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+}
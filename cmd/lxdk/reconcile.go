@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/greymatter-io/lxdk/config"
+	lxdclient "github.com/lxc/lxd/client"
+	"github.com/lxc/lxd/shared/api"
+)
+
+// clusterStatus is the state of a cluster's nodes as reported by LXD, as
+// opposed to the state recorded in state.toml.
+type clusterStatus struct {
+	RunState config.RunState
+	Running  []string
+	Stopped  []string
+	Missing  []string
+}
+
+// isRunning returns true if LXD reported the container as running.
+func (s clusterStatus) isRunning(container string) bool {
+	for _, name := range s.Running {
+		if name == container {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reconcileState asks LXD for the state of every node in the cluster, works
+// out the effective RunState and corrects state if the recorded RunState
+// disagrees. Callers are responsible for writing the corrected state.
+func reconcileState(state *config.ClusterState, is lxdclient.InstanceServer) (clusterStatus, error) {
+	var status clusterStatus
+	for _, name := range state.Containers {
+		instState, _, err := is.GetInstanceState(name)
+		if err != nil {
+			if api.StatusErrorCheck(err, http.StatusNotFound) {
+				status.Missing = append(status.Missing, name)
+				continue
+			}
+			return status, err
+		}
+
+		if instState.StatusCode == api.Running {
+			status.Running = append(status.Running, name)
+		} else {
+			status.Stopped = append(status.Stopped, name)
+		}
+	}
+
+	switch {
+	case len(status.Running) == 0 && len(status.Missing) == 0 && state.RunState == config.Uninitialized:
+		// never started
+		status.RunState = config.Uninitialized
+	case len(status.Missing) == 0 && state.RunState == config.Failed:
+		// only a successful start clears a failure
+		status.RunState = config.Failed
+	case len(status.Running) == 0 && len(status.Missing) == 0:
+		status.RunState = config.Stopped
+	case len(status.Running) == len(state.Containers) && state.RunState != config.Uninitialized:
+		status.RunState = config.Running
+	default:
+		status.RunState = config.Degraded
+	}
+
+	if len(status.Missing) > 0 {
+		log.Default().Printf("cluster %s is missing nodes: %s", state.Name, strings.Join(status.Missing, ", "))
+	}
+
+	if status.RunState != state.RunState {
+		log.Default().Printf("cluster %s was recorded as %s but is %s, updating state", state.Name, state.RunState, status.RunState)
+		state.RunState = status.RunState
+	}
+
+	return status, nil
+}
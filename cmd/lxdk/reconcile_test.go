@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/greymatter-io/lxdk/config"
+	"github.com/lxc/lxd/shared/api"
+)
+
+func TestReconcileState(t *testing.T) {
+	nodes := []string{"etcd", "controller", "worker"}
+	tests := []struct {
+		name     string
+		recorded config.RunState
+		states   map[string]api.StatusCode
+		want     config.RunState
+		missing  []string
+	}{
+		{
+			name:     "running",
+			recorded: config.Running,
+			states:   map[string]api.StatusCode{"etcd": api.Running, "controller": api.Running, "worker": api.Running},
+			want:     config.Running,
+		},
+		{
+			name:     "stopped outside lxdk",
+			recorded: config.Running,
+			states:   map[string]api.StatusCode{"etcd": api.Stopped, "controller": api.Stopped, "worker": api.Stopped},
+			want:     config.Stopped,
+		},
+		{
+			name:     "started outside lxdk",
+			recorded: config.Stopped,
+			states:   map[string]api.StatusCode{"etcd": api.Running, "controller": api.Running, "worker": api.Running},
+			want:     config.Running,
+		},
+		{
+			name:     "never started",
+			recorded: config.Uninitialized,
+			states:   map[string]api.StatusCode{"etcd": api.Stopped, "controller": api.Stopped, "worker": api.Stopped},
+			want:     config.Uninitialized,
+		},
+		{
+			name:     "started but never provisioned",
+			recorded: config.Uninitialized,
+			states:   map[string]api.StatusCode{"etcd": api.Running, "controller": api.Running, "worker": api.Running},
+			want:     config.Degraded,
+		},
+		{
+			name:     "partly running",
+			recorded: config.Running,
+			states:   map[string]api.StatusCode{"etcd": api.Running, "controller": api.Running, "worker": api.Stopped},
+			want:     config.Degraded,
+		},
+		{
+			name:     "failed stays failed",
+			recorded: config.Failed,
+			states:   map[string]api.StatusCode{"etcd": api.Running, "controller": api.Running, "worker": api.Running},
+			want:     config.Failed,
+		},
+		{
+			name:     "missing node",
+			recorded: config.Running,
+			states:   map[string]api.StatusCode{"etcd": api.Running, "controller": api.Running},
+			want:     config.Degraded,
+			missing:  []string{"worker"},
+		},
+		{
+			name:     "missing node of a failed cluster",
+			recorded: config.Failed,
+			states:   map[string]api.StatusCode{"etcd": api.Stopped, "controller": api.Stopped},
+			want:     config.Degraded,
+			missing:  []string{"worker"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := config.ClusterState{Name: "test", Containers: nodes, RunState: tt.recorded}
+
+			status, err := reconcileState(&state, &fakeGCServer{states: tt.states})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.RunState != tt.want || state.RunState != tt.want {
+				t.Errorf("expected %s, got status %s and state %s", tt.want, status.RunState, state.RunState)
+			}
+			if !reflect.DeepEqual(status.Missing, tt.missing) {
+				t.Errorf("expected missing nodes %v, got %v", tt.missing, status.Missing)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/greymatter-io/lxdk/config"
+	"github.com/greymatter-io/lxdk/containers"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// shellCmd opens an interactive shell, or runs an interactive command, on a
+// node picked by role instead of by container name.
+var shellCmd = &cli.Command{
+	Name:      "shell",
+	Usage:     "open an interactive shell on a node",
+	ArgsUsage: "<cluster name> <node> [-- command...]",
+	Description: "node is etcd, controller, registry, worker-<n> or a container name. " +
+		"A login shell is started unless a command is given.",
+	Action: doShell,
+}
+
+func doShell(ctx *cli.Context) error {
+	state, err := config.ClusterStateFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	selector := ctx.Args().Get(1)
+	if selector == "" {
+		return errors.New("must supply node")
+	}
+
+	nodes, err := state.ResolveNodes(selector)
+	if err != nil {
+		return err
+	}
+	if len(nodes) != 1 {
+		return errors.Errorf("%s is %d nodes, shell needs exactly one", selector, len(nodes))
+	}
+
+	command := []string{"su", "-l"}
+	if args := commandArgs(ctx.Args().Slice()[2:]); len(args) > 0 {
+		command = args
+	}
+
+	is, _, err := connectCluster(ctx, state)
+	if err != nil {
+		return err
+	}
+
+	code, err := containers.ExecInteractive(nodes[0], command, is)
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return cli.Exit("", code)
+	}
+
+	return nil
+}
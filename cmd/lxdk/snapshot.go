@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/greymatter-io/lxdk/config"
+	"github.com/greymatter-io/lxdk/containers"
+	lxdclient "github.com/lxc/lxd/client"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// snapshotCmd manages snapshots taken of every node of a cluster at once, so
+// a cluster can be rolled back as a whole.
+var snapshotCmd = &cli.Command{
+	Name:  "snapshot",
+	Usage: "create, list, restore and delete snapshots of a whole cluster",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "create",
+			Usage:     "snapshot every node of a cluster",
+			ArgsUsage: "<cluster name> [snapshot name]",
+			Action:    doSnapshotCreate,
+		},
+		{
+			Name:      "list",
+			Usage:     "list the snapshots of a cluster",
+			ArgsUsage: "<cluster name>",
+			Action:    doSnapshotList,
+		},
+		{
+			Name:      "restore",
+			Usage:     "roll every node of a cluster back to a snapshot",
+			ArgsUsage: "<cluster name> <snapshot name>",
+			Action:    doSnapshotRestore,
+		},
+		{
+			Name:      "delete",
+			Usage:     "delete a snapshot from every node of a cluster",
+			ArgsUsage: "<cluster name> <snapshot name>",
+			Action:    doSnapshotDelete,
+		},
+	},
+}
+
+func doSnapshotCreate(ctx *cli.Context) error {
+	state, err := config.ClusterStateFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	name := ctx.Args().Get(1)
+	if name == "" {
+		name = time.Now().UTC().Format("snap-20060102-150405")
+	}
+	if strings.Contains(name, "/") {
+		return errors.Errorf("snapshot name %s must not contain /", name)
+	}
+	if _, ok := state.Snapshot(name); ok {
+		return errors.Errorf("cluster %s already has a snapshot named %s", state.Name, name)
+	}
+
+	is, _, err := connectCluster(ctx, state)
+	if err != nil {
+		return err
+	}
+
+	status, err := reconcileState(&state, is)
+	if err != nil {
+		return err
+	}
+	if len(status.Missing) > 0 {
+		return errors.Errorf("cluster %s is missing nodes %s and cannot be snapshotted", state.Name, strings.Join(status.Missing, ", "))
+	}
+
+	if err := snapshotCluster(state, name, status.isRunning(state.EtcdContainerName), ctx.Int("parallelism"), is); err != nil {
+		return err
+	}
+
+	state.Snapshots = append(state.Snapshots, config.Snapshot{
+		Name:        name,
+		RunState:    status.RunState,
+		Provisioned: state.Provisioned,
+		CreatedAt:   time.Now().UTC(),
+	})
+	if err := config.WriteClusterState(ctx, state); err != nil {
+		return err
+	}
+
+	log.Default().Printf("created snapshot %s of cluster %s", name, state.Name)
+
+	return nil
+}
+
+// snapshotCluster snapshots every node of state under name. If etcdRunning
+// is true etcd is frozen while it is snapshotted, so its data is consistent.
+// If any node fails, the snapshots already taken are removed again.
+func snapshotCluster(state config.ClusterState, name string, etcdRunning bool, parallelism int, is lxdclient.InstanceServer) error {
+	// etcd holds the state of the cluster, so it is snapshotted on its own
+	// first; everything else only has to be close to it
+	if err := snapshotEtcd(state.EtcdContainerName, name, etcdRunning, is); err != nil {
+		return err
+	}
+
+	var rest []string
+	for _, container := range state.Containers {
+		if container != state.EtcdContainerName {
+			rest = append(rest, container)
+		}
+	}
+
+	err := forEachNode(rest, parallelism, func(container string) error {
+		return containers.CreateSnapshot(container, name, is)
+	})
+	if err != nil {
+		taken := []string{state.EtcdContainerName}
+		if errs, ok := err.(nodeErrors); ok {
+			for _, container := range rest {
+				if errs[container] == nil {
+					taken = append(taken, container)
+				}
+			}
+		}
+		for _, container := range taken {
+			if derr := containers.DeleteSnapshot(container, name, is); derr != nil {
+				log.Default().Printf("could not remove partial snapshot: %s", derr)
+			}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// snapshotEtcd snapshots the etcd container under name, freezing it for the
+// duration if it is running.
+func snapshotEtcd(container, name string, running bool, is lxdclient.InstanceServer) error {
+	if running {
+		if err := containers.FreezeContainer(container, is); err != nil {
+			return err
+		}
+		// the snapshot is good even if this fails, but etcd has to be
+		// resumed by hand
+		defer func() {
+			if err := containers.UnfreezeContainer(container, is); err != nil {
+				log.Default().Printf("%s, run lxc start %s to resume it", err, container)
+			}
+		}()
+	}
+
+	return containers.CreateSnapshot(container, name, is)
+}
+
+func doSnapshotList(ctx *cli.Context) error {
+	state, err := config.ClusterStateFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	is, _, err := connectCluster(ctx, state)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATE\tNODES\tCREATED")
+	for _, snap := range state.Snapshots {
+		var present int
+		for _, container := range state.Containers {
+			ok, err := containers.HasSnapshot(container, snap.Name, is)
+			if err != nil {
+				return err
+			}
+			if ok {
+				present++
+			}
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%d/%d\t%s\n", snap.Name, snap.RunState, present, len(state.Containers), snap.CreatedAt.Local().Format("2006-01-02 15:04"))
+	}
+
+	return w.Flush()
+}
+
+func doSnapshotRestore(ctx *cli.Context) error {
+	state, err := config.ClusterStateFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	name := ctx.Args().Get(1)
+	if name == "" {
+		return errors.New("must supply snapshot name")
+	}
+	snap, ok := state.Snapshot(name)
+	if !ok {
+		return errors.Errorf("cluster %s has no snapshot named %s", state.Name, name)
+	}
+
+	is, hostname, err := connectCluster(ctx, state)
+	if err != nil {
+		return err
+	}
+
+	status, err := reconcileState(&state, is)
+	if err != nil {
+		return err
+	}
+	if len(status.Missing) > 0 {
+		return errors.Errorf("cluster %s is missing nodes %s and cannot be restored", state.Name, strings.Join(status.Missing, ", "))
+	}
+
+	var lacking []string
+	for _, container := range state.Containers {
+		ok, err := containers.HasSnapshot(container, name, is)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			lacking = append(lacking, container)
+		}
+	}
+	if len(lacking) > 0 {
+		return errors.Errorf("nodes %s have no snapshot %s", strings.Join(lacking, ", "), name)
+	}
+
+	parallelism := ctx.Int("parallelism")
+
+	// nothing may write to etcd while it is rolled back
+	err = forEachNode(status.Running, parallelism, func(container string) error {
+		log.Default().Println("stopping " + container)
+		return containers.StopContainer(container, is)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := containers.RestoreSnapshot(state.EtcdContainerName, name, is); err != nil {
+		return err
+	}
+	var rest []string
+	for _, container := range state.Containers {
+		if container != state.EtcdContainerName {
+			rest = append(rest, container)
+		}
+	}
+	err = forEachNode(rest, parallelism, func(container string) error {
+		return containers.RestoreSnapshot(container, name, is)
+	})
+	if err != nil {
+		return err
+	}
+
+	state.RunState = snap.RunState
+	state.Provisioned = snap.Provisioned
+	if snap.RunState == config.Running {
+		err = forEachNode(state.Containers, parallelism, func(container string) error {
+			log.Default().Println("starting " + container)
+			if err := containers.StartContainer(ctx.Context, container, is); err != nil {
+				return err
+			}
+
+			_, err := waitIP(ctx, container, hostname, is)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := recordNodeAddresses(ctx, &state, hostname, is); err != nil {
+			return err
+		}
+		state.StartedAt = time.Now().UTC()
+	} else {
+		state.StoppedAt = time.Now().UTC()
+	}
+
+	if _, err := reconcileState(&state, is); err != nil {
+		return err
+	}
+	if err := config.WriteClusterState(ctx, state); err != nil {
+		return err
+	}
+
+	log.Default().Printf("restored cluster %s to snapshot %s, it is %s", state.Name, name, state.RunState)
+
+	return nil
+}
+
+func doSnapshotDelete(ctx *cli.Context) error {
+	state, err := config.ClusterStateFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	name := ctx.Args().Get(1)
+	if name == "" {
+		return errors.New("must supply snapshot name")
+	}
+	if _, ok := state.Snapshot(name); !ok {
+		return errors.Errorf("cluster %s has no snapshot named %s", state.Name, name)
+	}
+
+	is, _, err := connectCluster(ctx, state)
+	if err != nil {
+		return err
+	}
+
+	err = forEachNode(state.Containers, ctx.Int("parallelism"), func(container string) error {
+		return containers.DeleteSnapshot(container, name, is)
+	})
+	if err != nil {
+		return err
+	}
+
+	state.RemoveSnapshot(name)
+	if err := config.WriteClusterState(ctx, state); err != nil {
+		return err
+	}
+
+	log.Default().Printf("deleted snapshot %s of cluster %s", name, state.Name)
+
+	return nil
+}
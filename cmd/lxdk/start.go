@@ -3,10 +3,13 @@ package main
 import (
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/greymatter-io/lxdk/certificates"
 	certs "github.com/greymatter-io/lxdk/certificates"
@@ -30,6 +33,15 @@ var (
 				Usage: "use the IP of the lxc remote to access the API instead of the controller container",
 				Value: false,
 			},
+			&cli.BoolFlag{
+				Name:  "force",
+				Usage: "start the cluster even if lxdk believes it is already running",
+			},
+			&cli.BoolFlag{
+				Name:  "reprovision",
+				Usage: "provision a cluster that was started before from the beginning, instead of only starting its nodes",
+			},
+			mountFlag,
 		},
 	}
 )
@@ -39,49 +51,166 @@ var (
 // TODO: split this up into individual commands, each with their own tests to
 // make sure each service is configured correctly
 func doStart(ctx *cli.Context) error {
-	cacheDir := ctx.String("cache")
 	if ctx.Args().Len() == 0 {
 		return fmt.Errorf("must supply cluster name")
 	}
-	clusterName := ctx.Args().First()
+
+	return provisionCluster(ctx, ctx.Args().First(), ctx.Bool("force"))
+}
+
+// provisionCluster starts and provisions the cluster named clusterName. Commands
+// other than start call it for clusters that aren't named by their first
+// argument. A cluster that was provisioned before is only restarted. If
+// workers or the registry changed address only they, and the certificates and
+// configuration naming them, are updated, but a cluster whose etcd or
+// controller moved is provisioned again. If provisioning fails or is
+// interrupted once nodes are being started, the cluster is recorded as
+// failed and is provisioned from the beginning next time. If a provisioned
+// cluster fails to restart it is recorded as degraded and stays provisioned.
+func provisionCluster(ctx *cli.Context, clusterName string, force bool) (err error) {
+	cacheDir := ctx.String("cache")
 	certDir := path.Join(cacheDir, clusterName, "certificates")
 
-	state, err := config.ClusterStateFromContext(ctx)
+	state, err := config.LoadClusterState(cacheDir, clusterName)
 	if err != nil {
 		return err
 	}
+	state.Name = clusterName
 
-	if state.RunState == config.Running {
-		return fmt.Errorf("cluster %s is already running or was not stopped by lxdk", clusterName)
+	is, hostname, err := connectCluster(ctx, state)
+	if err != nil {
+		return err
 	}
 
-	is, hostname, err := lxd.InstanceServerConnect()
+	status, err := reconcileState(&state, is)
 	if err != nil {
 		return err
 	}
+	if err := config.SaveClusterState(cacheDir, state); err != nil {
+		return err
+	}
 
-	for _, containerName := range state.Containers {
-		state, _, err := is.GetInstanceState(containerName)
-		if err != nil {
-			return err
+	if len(status.Missing) > 0 {
+		return fmt.Errorf("cluster %s is missing nodes %s and cannot be started", clusterName, strings.Join(status.Missing, ", "))
+	}
+
+	if state.RunState == config.Running && !force {
+		return fmt.Errorf("cluster %s is already running, use --force to start it anyway", clusterName)
+	}
+
+	mounts, err := mountFlags(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		state.SetMount(m)
+	}
+
+	// restarting is set once a provisioned cluster is only being restarted,
+	// so that a failure doesn't throw its provisioning away
+	restarting := false
+	defer func() {
+		if err == nil {
+			return
 		}
 
-		if state.Status == "Running" {
-			return fmt.Errorf("container %s is already running", containerName)
+		if restarting {
+			state.RunState = config.Degraded
+		} else {
+			state.RunState = config.Failed
+			state.Provisioned = false
+		}
+		if serr := config.SaveClusterState(cacheDir, state); serr != nil {
+			log.Default().Printf("could not record that cluster %s failed: %s", clusterName, serr)
+			return
 		}
+		if restarting {
+			log.Default().Printf("cluster %s did not restart cleanly, run lxdk start --force to check it again or lxdk start --reprovision to provision it again", clusterName)
+			return
+		}
+		log.Default().Printf("cluster %s failed to start, run lxdk start to retry or lxdk delete to remove it", clusterName)
+	}()
+
+	if err := applyMounts(state, state.Mounts, is); err != nil {
+		return err
 	}
 
+	if err := attachDevices(ctx, state.Nodes, is); err != nil {
+		return err
+	}
+
+	var toStart []string
 	for _, container := range state.Containers {
+		if status.isRunning(container) {
+			log.Default().Println(container + " is already running")
+			continue
+		}
+		toStart = append(toStart, container)
+	}
+
+	err = forEachNode(toStart, ctx.Int("parallelism"), func(container string) error {
+		if err := interrupted(ctx); err != nil {
+			return err
+		}
 		log.Default().Println("starting " + container)
-		err = containers.StartContainer(container, is)
-		if err != nil {
+		if err := containers.StartContainer(ctx.Context, container, is); err != nil {
 			return err
 		}
 
+		_, err := waitIP(ctx, container, hostname, is)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	previous := make(map[string]string)
+	for _, node := range state.Nodes {
+		previous[node.Name] = node.IP
+	}
+
+	err = recordNodeAddresses(ctx, &state, hostname, is)
+	if err != nil {
+		return err
+	}
+
+	if state.Provisioned && !ctx.Bool("reprovision") {
+		var moved []config.Node
+		var movedNames []string
+		core := false
+		for _, node := range state.Nodes {
+			if previous[node.Name] == node.IP {
+				continue
+			}
+			moved = append(moved, node)
+			movedNames = append(movedNames, node.Name)
+			if node.Role == config.RoleEtcd || node.Role == config.RoleController {
+				core = true
+			}
+		}
+		if len(moved) == 0 {
+			restarting = true
+			return restartCluster(ctx, &state, cacheDir, is)
+		}
+		if !core {
+			restarting = true
+			err = reconfigureNodes(ctx, &state, cacheDir, hostname, moved, is)
+			if err != nil {
+				// keep the old addresses so that the moved nodes are
+				// reconfigured again next time
+				for i, node := range state.Nodes {
+					state.Nodes[i].IP = previous[node.Name]
+				}
+			}
+			return err
+		}
+		// the addresses of etcd and the controller are in the certificates
+		// and kubeconfigs of every node
+		log.Default().Printf("%s changed address, provisioning cluster %s again", strings.Join(movedNames, ", "), clusterName)
 	}
 
 	// etcd cert
-	etcdIP, err := containers.WaitContainerIP(state.EtcdContainerName, []string{hostname}, is)
+	etcdIP, err := waitIP(ctx, state.EtcdContainerName, hostname, is)
 	if err != nil {
 		return err
 	}
@@ -105,26 +234,11 @@ func doStart(ctx *cli.Context) error {
 		return err
 	}
 
-	controllerIP, err := containers.WaitContainerIP(state.ControllerContainerName, []string{hostname}, is)
+	controllerIP, err := waitIP(ctx, state.ControllerContainerName, hostname, is)
 	if err != nil {
 		return err
 	}
-	controllerCertConfig := certs.CertConfig{
-		Name: "kubernetes",
-		CN:   "kubernetes",
-		CA: certs.CAConfig{
-			Name: "ca",
-			Dir:  certDir,
-			CN:   "Kubernetes",
-		},
-		Dir:          certDir,
-		CAConfigPath: path.Join(certDir, "ca-config.json"),
-		ExtraOpts: map[string]string{
-			"hostname": "10.32.0.1," + controllerIP.String() + ",127.0.0.1," + hostname,
-		},
-	}
-
-	err = certificates.CreateCert(controllerCertConfig)
+	err = createAPIServerCert(state, certDir, controllerIP.String(), hostname)
 	if err != nil {
 		return err
 	}
@@ -132,10 +246,15 @@ func doStart(ctx *cli.Context) error {
 	// worker cert
 	workerContainers := state.WorkerContainerNames
 	workerContainers = append(workerContainers, state.ControllerContainerName)
-	for _, container := range workerContainers {
-		if err = createWorkerCert(container, certDir, hostname, is); err != nil {
-			return err
-		}
+	err = forEachNode(workerContainers, ctx.Int("parallelism"), func(container string) error {
+		return createWorkerCert(ctx, container, certDir, hostname, is)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := interrupted(ctx); err != nil {
+		return err
 	}
 
 	// configure etcd
@@ -154,7 +273,7 @@ func doStart(ctx *cli.Context) error {
 		return err
 	}
 
-	err = containers.RunCommands(state.EtcdContainerName, []string{
+	err = containers.RunCommands(ctx.Context, state.EtcdContainerName, []string{
 		"systemctl daemon-reload",
 		"systemctl -q enable etcd",
 		"systemctl start etcd",
@@ -164,7 +283,7 @@ func doStart(ctx *cli.Context) error {
 	}
 
 	// configure registry
-	err = containers.RunCommands(state.RegistryContainerName, []string{
+	err = containers.RunCommands(ctx.Context, state.RegistryContainerName, []string{
 		"systemctl daemon-reload",
 		"systemctl -q enable oci-registry",
 		"systemctl start oci-registry",
@@ -173,6 +292,10 @@ func doStart(ctx *cli.Context) error {
 		return err
 	}
 
+	if err := interrupted(ctx); err != nil {
+		return err
+	}
+
 	// configure controller
 	kfgPath := path.Join(cacheDir, state.Name, "kubeconfigs")
 	err = os.MkdirAll(kfgPath, 0755)
@@ -185,7 +308,7 @@ func doStart(ctx *cli.Context) error {
 		return err
 	}
 
-	err = createControllerKubeconfig(state.ControllerContainerName, path.Join(cacheDir, state.Name), controllerIP.String(), hostname, is)
+	err = createControllerKubeconfig(ctx, state.ControllerContainerName, path.Join(cacheDir, state.Name), controllerIP.String(), hostname, is)
 	if err != nil {
 		return err
 	}
@@ -216,7 +339,7 @@ func doStart(ctx *cli.Context) error {
 		return err
 	}
 
-	err = containers.RunCommands(state.ControllerContainerName, []string{
+	err = containers.RunCommands(ctx.Context, state.ControllerContainerName, []string{
 		"systemctl daemon-reload",
 		"systemctl -q enable kube-apiserver",
 		"systemctl start kube-apiserver",
@@ -276,14 +399,23 @@ func doStart(ctx *cli.Context) error {
 		return err
 	}
 
+	if err := interrupted(ctx); err != nil {
+		return err
+	}
+
 	// configure controller as worker
 	// configure worker(s)
-	registryIP, err := containers.WaitContainerIP(state.RegistryContainerName, []string{hostname}, is)
+	registryIP, err := waitIP(ctx, state.RegistryContainerName, hostname, is)
 	if err != nil {
 		return err
 	}
 
-	for _, worker := range workerContainers {
+	err = createKubeProxyKubeconfig(controllerIP.String(), path.Join(cacheDir, state.Name))
+	if err != nil {
+		return err
+	}
+
+	err = forEachNode(workerContainers, ctx.Int("parallelism"), func(worker string) error {
 		containerConfig := workerConfig{
 			ContainerName: worker,
 			ControllerIP:  controllerIP.String(),
@@ -291,11 +423,17 @@ func doStart(ctx *cli.Context) error {
 			RegistryIP:    registryIP.String(),
 			EtcdIP:        etcdIP.String(),
 			ClusterDir:    path.Join(cacheDir, state.Name),
+			CgroupMode:    state.CgroupMode,
+			Unprivileged:  state.Unprivileged,
 		}
-		err = configureWorker(containerConfig, is)
-		if err != nil {
-			return err
-		}
+		return configureWorker(ctx, containerConfig, is)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := interrupted(ctx); err != nil {
+		return err
 	}
 
 	// create admin kubeconfig
@@ -304,16 +442,9 @@ func doStart(ctx *cli.Context) error {
 		return err
 	}
 
-	if ctx.Bool("use-remote-ip") {
-		err = createClientKubeconfig(path.Join(cacheDir, state.Name), hostname)
-		if err != nil {
-			return err
-		}
-	} else {
-		err = createClientKubeconfig(path.Join(cacheDir, state.Name), controllerIP.String())
-		if err != nil {
-			return err
-		}
+	err = createClientKubeconfig(path.Join(cacheDir, state.Name), clientServer(state, controllerIP.String(), hostname, ctx.Bool("use-remote-ip")))
+	if err != nil {
+		return err
 	}
 
 	clientset, err := kubernetes.GetClientset(path.Join(cacheDir, state.Name, "kubeconfigs", "client.kubeconfig"))
@@ -322,51 +453,65 @@ func doStart(ctx *cli.Context) error {
 	}
 
 	log.Default().Println("waiting for API server...")
-	err = kubernetes.WaitAPIServerReady(*clientset)
+	// the API server phase lasts until the cluster's own resources are
+	// deployed
+	apiCtx, cancelAPI := phaseContext(ctx, "api-timeout")
+	defer cancelAPI()
+	err = kubernetes.WaitAPIServerReady(apiCtx, *clientset)
+	if err != nil {
+		return err
+	}
+
+	state.KubernetesVersion, err = kubernetes.ServerVersion(*clientset)
 	if err != nil {
 		return err
 	}
 
 	log.Default().Println("configuring RBAC")
-	err = kubernetes.ConfigureRBAC(*clientset)
+	err = kubernetes.ConfigureRBAC(apiCtx, *clientset)
 	if err != nil {
 		return err
 	}
 
 	// flannel
 	log.Default().Println("setting up flannel networking")
-	err = kubernetes.DeployManifest(path.Join(cacheDir, state.Name), kubernetes.FlannelManifest())
+	err = kubernetes.DeployManifest(apiCtx, path.Join(cacheDir, state.Name), kubernetes.FlannelManifest())
 	if err != nil {
 		return err
 	}
 
 	// core dns
 	log.Default().Println("deploying core DNS")
-	err = kubernetes.DeployManifest(path.Join(cacheDir, state.Name), kubernetes.CoreDNSManifest())
+	err = kubernetes.DeployManifest(apiCtx, path.Join(cacheDir, state.Name), kubernetes.CoreDNSManifest())
 	if err != nil {
 		return err
 	}
 
 	log.Default().Println("waiting for controller node to become ready")
-	err = kubernetes.WaitNode(*clientset, state.ControllerContainerName)
+	nodeCtx, cancelNode := phaseContext(ctx, "node-timeout")
+	err = kubernetes.WaitNode(nodeCtx, *clientset, state.ControllerContainerName)
+	cancelNode()
 	if err != nil {
 		return err
 	}
 
+	versions, err := kubernetes.ComponentVersions(ctx.Context, *clientset, state.ControllerContainerName)
+	if err != nil {
+		log.Default().Printf("could not record component versions: %s", err)
+	} else {
+		state.ComponentVersions = versions
+	}
+
 	log.Default().Println("labeling and tainting controller node")
-	kfg := path.Join(cacheDir, state.Name, "kubeconfigs", "client.kubeconfig")
-	// label and taint controller
-	err = containers.RunCommands(state.ControllerContainerName, []string{
-		fmt.Sprintf(`kubectl --kubeconfig=%s label node %s node-role.kubernetes.io/master=""`, kfg, state.ControllerContainerName),
-		fmt.Sprintf(`kubectl --kubeconfig=%s label node %s ingress-nginx=""`, kfg, state.ControllerContainerName),
-		fmt.Sprintf(`kubectl --kubeconfig=%s taint node %s node-role.kubernetes.io/master=:NoSchedule`, kfg, state.ControllerContainerName),
-	}, is)
+	err = kubernetes.MarkController(ctx.Context, *clientset, state.ControllerContainerName)
 	if err != nil {
 		return err
 	}
 
 	state.RunState = config.Running
-	if err := config.WriteClusterState(ctx, state); err != nil {
+	state.Provisioned = true
+	state.StartedAt = time.Now().UTC()
+	if err := config.SaveClusterState(cacheDir, state); err != nil {
 		return err
 	}
 
@@ -375,11 +520,147 @@ func doStart(ctx *cli.Context) error {
 	return nil
 }
 
-func createWorkerCert(worker, certDir, hostname string, is lxdclient.InstanceServer) error {
-	ip, err := containers.WaitContainerIP(worker, []string{hostname}, is)
+// restartCluster finishes starting a provisioned cluster whose nodes are
+// running at the addresses their certificates and kubeconfigs were made
+// for, by waiting for the API server and every node to be ready.
+func restartCluster(ctx *cli.Context, state *config.ClusterState, cacheDir string, is lxdclient.InstanceServer) error {
+	nodes := append([]string{state.ControllerContainerName}, state.WorkerContainerNames...)
+	// clusters provisioned before /dev/kmsg was linked on boot lost the
+	// link when their nodes stopped, the kubelet restarts once it's back
+	err := forEachNode(nodes, ctx.Int("parallelism"), func(node string) error {
+		return linkKmsg(ctx, node, is)
+	})
+	if err != nil {
+		return err
+	}
+
+	clientset, err := kubernetes.GetClientset(path.Join(cacheDir, state.Name, "kubeconfigs", "client.kubeconfig"))
+	if err != nil {
+		return err
+	}
+
+	log.Default().Println("waiting for API server...")
+	apiCtx, cancelAPI := phaseContext(ctx, "api-timeout")
+	err = kubernetes.WaitAPIServerReady(apiCtx, *clientset)
+	cancelAPI()
+	if err != nil {
+		return err
+	}
+
+	log.Default().Println("waiting for nodes to become ready")
+	err = forEachNode(nodes, ctx.Int("parallelism"), func(node string) error {
+		nodeCtx, cancelNode := phaseContext(ctx, "node-timeout")
+		defer cancelNode()
+		return kubernetes.WaitNodeReady(nodeCtx, *clientset, node)
+	})
+	if err != nil {
+		return err
+	}
+
+	state.RunState = config.Running
+	state.StartedAt = time.Now().UTC()
+	if err := config.SaveClusterState(cacheDir, *state); err != nil {
+		return err
+	}
+	log.Default().Printf("restarted cluster %s", state.Name)
+
+	return nil
+}
+
+// reconfigureNodes restarts a provisioned cluster whose workers or registry
+// changed address. Moved workers get a certificate for their new address, and
+// every node running a kubelet is pointed at a moved registry. The rest of the
+// cluster is left as it was provisioned.
+func reconfigureNodes(ctx *cli.Context, state *config.ClusterState, cacheDir, hostname string, moved []config.Node, is lxdclient.InstanceServer) error {
+	certDir := path.Join(cacheDir, state.Name, "certificates")
+	kubeletNodes := append([]string{state.ControllerContainerName}, state.WorkerContainerNames...)
+
+	for _, node := range moved {
+		if err := interrupted(ctx); err != nil {
+			return err
+		}
+
+		switch node.Role {
+		case config.RoleWorker:
+			nodeLogger(node.Name).Printf("changed address to %s", node.IP)
+			err := createWorkerCert(ctx, node.Name, certDir, hostname, is)
+			if err != nil {
+				return err
+			}
+
+			lowerName := strings.ToLower(node.Name)
+			err = containers.UploadFiles([]string{
+				path.Join(certDir, lowerName+".pem"),
+				path.Join(certDir, lowerName+"-key.pem"),
+			}, "/etc/kubernetes/", node.Name, is)
+			if err != nil {
+				return err
+			}
+
+			err = containers.RunCommand(ctx.Context, node.Name, "systemctl restart kubelet", is)
+			if err != nil {
+				return err
+			}
+		case config.RoleRegistry:
+			nodeLogger(node.Name).Printf("changed address to %s, updating the registry configuration of every node", node.IP)
+			registryConf := kubernetes.WorkerRegistriesConfig(node.Name, node.IP)
+			err := forEachNode(kubeletNodes, ctx.Int("parallelism"), func(container string) error {
+				err := containers.UploadFile(registryConf, "", "/etc/containers/registries.conf", container, is)
+				if err != nil {
+					return err
+				}
+
+				// the kubelet requires crio and is restarted with it
+				return containers.RunCommand(ctx.Context, container, "systemctl restart crio", is)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return restartCluster(ctx, state, cacheDir, is)
+}
+
+// linkKmsg installs the tmpfiles.d entry linking /dev/kmsg to /dev/console
+// on container and creates the link, which the kubelet needs to start.
+func linkKmsg(ctx *cli.Context, container string, is lxdclient.InstanceServer) error {
+	err := containers.UploadFile(kubernetes.KmsgTmpfilesConfig(), "", "/etc/tmpfiles.d/lxdk-kmsg.conf", container, is)
 	if err != nil {
 		return err
 	}
+
+	return containers.RunCommand(ctx.Context, container, "systemd-tmpfiles --create /etc/tmpfiles.d/lxdk-kmsg.conf", is)
+}
+
+// recordNodeAddresses waits for every node to get an address on the cluster
+// network and records it, along with the node's MAC address, in state.
+func recordNodeAddresses(ctx *cli.Context, state *config.ClusterState, hostname string, is lxdclient.InstanceServer) error {
+	for i, node := range state.Nodes {
+		ip, err := waitIP(ctx, node.Name, hostname, is)
+		if err != nil {
+			return err
+		}
+
+		mac, err := containers.GetContainerMAC(node.Name, is)
+		if err != nil {
+			return err
+		}
+
+		state.Nodes[i].IP = ip.String()
+		state.Nodes[i].MAC = mac
+	}
+
+	return nil
+}
+
+func createWorkerCert(ctx *cli.Context, worker, certDir, hostname string, is lxdclient.InstanceServer) error {
+	logger := nodeLogger(worker)
+	ip, err := waitIP(ctx, worker, hostname, is)
+	if err != nil {
+		return err
+	}
+	logger.Println("creating certificate")
 	workerCertConfig := certs.CertConfig{
 		Name:     "node:" + strings.ToLower(worker),
 		FileName: strings.ToLower(worker),
@@ -395,13 +676,14 @@ func createWorkerCert(worker, certDir, hostname string, is lxdclient.InstanceSer
 			"hostname": ip.String() + "," + worker,
 		},
 		JSONOverride: certs.CertJSON("system:node:"+strings.ToLower(worker), "system:nodes"),
+		Logger:       logger,
 	}
 
 	return certificates.CreateCert(workerCertConfig)
 }
 
-func createControllerKubeconfig(container, clusterDir, controllerIP, hostname string, is lxdclient.InstanceServer) error {
-	ip, err := containers.WaitContainerIP(container, []string{hostname}, is)
+func createControllerKubeconfig(ctx *cli.Context, container, clusterDir, controllerIP, hostname string, is lxdclient.InstanceServer) error {
+	ip, err := waitIP(ctx, container, hostname, is)
 	if err != nil {
 		return err
 	}
@@ -513,9 +795,18 @@ type workerConfig struct {
 	RegistryIP    string
 	EtcdIP        string
 	ClusterDir    string
+	CgroupMode    string
+	Unprivileged  bool
 }
 
-func configureWorker(wc workerConfig, is lxdclient.InstanceServer) error {
+// nodeLogger returns a logger that prefixes every line with the node name,
+// so the output of nodes configured concurrently can be told apart.
+func nodeLogger(name string) *log.Logger {
+	return log.New(log.Default().Writer(), "["+name+"] ", log.Default().Flags()|log.Lmsgprefix)
+}
+
+func configureWorker(ctx *cli.Context, wc workerConfig, is lxdclient.InstanceServer) error {
+	logger := nodeLogger(wc.ContainerName)
 	lowerName := strings.ToLower(wc.ContainerName)
 	var data []byte
 	if strings.Contains(wc.ContainerName, "controller") {
@@ -532,11 +823,13 @@ func configureWorker(wc workerConfig, is lxdclient.InstanceServer) error {
 	certDir := path.Join(wc.ClusterDir, "certificates")
 	kcfgDir := path.Join(wc.ClusterDir, "kubeconfigs")
 
+	logger.Println("creating kubelet kubeconfig")
 	err = createWorkerKubeconfig(lowerName, wc.ControllerIP, wc.ClusterDir)
 	if err != nil {
-		return err
+		return fmt.Errorf("could not create kubelet kubeconfig: %w", err)
 	}
 
+	logger.Println("uploading certificates and kubeconfigs")
 	workerCertPaths := []string{
 		path.Join(certDir, "ca.pem"),
 		path.Join(certDir, "ca-key.pem"),
@@ -560,74 +853,48 @@ func configureWorker(wc workerConfig, is lxdclient.InstanceServer) error {
 		return err
 	}
 
-	in, _, err := is.GetInstance(wc.ContainerName)
+	err = containers.RunCommands(ctx.Context, wc.ContainerName, []string{
+		"mkdir -p /etc/containers",
+		"mkdir -p /usr/share/containers/oci/hooks.d",
+		"ln -sf /etc/crio/policy.json /etc/containers/policy.json",
+		"mkdir -p /etc/cni/net.d",
+		"mkdir -p /etc/kubernetes/config",
+	}, is)
 	if err != nil {
 		return err
 	}
 
-	var newDevices api.InstancePut
-	newDevices = in.InstancePut
-
-	entries, err := os.ReadDir("/dev/")
-	if err != nil {
-		return fmt.Errorf("could read dir /dev: %w", err)
-	}
-	for _, entry := range entries {
-		if strings.Contains(entry.Name(), "loop") && len(entry.Name()) == 5 {
-			newDevices.Devices[entry.Name()] = map[string]string{
-				"type":   "unix-block",
-				"source": path.Join("/dev", entry.Name()),
-				"path":   path.Join("/dev", entry.Name()),
-			}
-		}
-	}
-	newDevices.Devices["net-tun"] = map[string]string{
-		"type":   "unix-char",
-		"source": "/dev/net/tun",
-		"path":   "/dev/net/tun",
-	}
-
-	op, err := is.UpdateInstance(wc.ContainerName, newDevices, "")
+	err = linkKmsg(ctx, wc.ContainerName, is)
 	if err != nil {
 		return err
 	}
 
-	err = op.Wait()
+	registryConf := kubernetes.WorkerRegistriesConfig(wc.RegistryName, wc.RegistryIP)
+	err = containers.UploadFile(registryConf, "", "/etc/containers/registries.conf", wc.ContainerName, is)
 	if err != nil {
 		return err
 	}
 
-	err = containers.RunCommands(wc.ContainerName, []string{
-		"mkdir -p /etc/containers",
-		"mkdir -p /usr/share/containers/oci/hooks.d",
-		"ln -s /etc/crio/policy.json /etc/containers/policy.json",
-		"mkdir -p /etc/cni/net.d",
-		"mkdir -p /etc/kubernetes/config",
-		"ln -s /dev/console /dev/kmsg",
-	}, is)
+	crioConf := kubernetes.CRIOCgroupConfig(wc.CgroupMode)
+	err = containers.UploadFile(crioConf, "", "/etc/crio/crio.conf.d/10-lxdk-cgroup.conf", wc.ContainerName, is)
 	if err != nil {
 		return err
 	}
 
-	registryConf := kubernetes.WorkerRegistriesConfig(wc.RegistryName, wc.RegistryIP)
-	err = containers.UploadFile(registryConf, "", "/etc/containers/registries.conf", wc.ContainerName, is)
-	if err != nil {
-		return nil
-	}
-
-	kubeletConf := kubernetes.KubeletConfig(lowerName)
+	kubeletConf := kubernetes.KubeletConfig(lowerName, wc.Unprivileged)
 	err = containers.UploadFile(kubeletConf, "", "/etc/kubernetes/config/kubelet.yaml", wc.ContainerName, is)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	kubeletUnit := kubernetes.KubeletUnitConfig(lowerName)
 	err = containers.UploadFile(kubeletUnit, "", "/etc/systemd/system/kubelet.service", wc.ContainerName, is)
 	if err != nil {
-		return nil
+		return err
 	}
 
-	err = containers.RunCommands(wc.ContainerName, []string{
+	logger.Println("starting crio, kubelet and kube-proxy")
+	err = containers.RunCommands(ctx.Context, wc.ContainerName, []string{
 		"systemctl daemon-reload",
 		"systemctl -q enable crio",
 		"systemctl start crio",
@@ -643,7 +910,9 @@ func configureWorker(wc workerConfig, is lxdclient.InstanceServer) error {
 	return nil
 }
 
-func createWorkerKubeconfig(container, controllerIP, clusterDir string) error {
+// createKubeProxyKubeconfig writes the kubeconfig shared by the kube-proxy of
+// every worker. It must be created before workers are configured.
+func createKubeProxyKubeconfig(controllerIP, clusterDir string) error {
 	certDir := path.Join(clusterDir, "certificates")
 	kfgDir := path.Join(clusterDir, "kubeconfigs")
 
@@ -695,7 +964,14 @@ func createWorkerKubeconfig(container, controllerIP, clusterDir string) error {
 		return fmt.Errorf("error on 'kubectl use-context': %s", out)
 	}
 
-	out, err = exec.Command("kubectl",
+	return nil
+}
+
+func createWorkerKubeconfig(container, controllerIP, clusterDir string) error {
+	certDir := path.Join(clusterDir, "certificates")
+	kfgDir := path.Join(clusterDir, "kubeconfigs")
+
+	out, err := exec.Command("kubectl",
 		"config",
 		"set-cluster",
 		"lxdk",
@@ -801,7 +1077,45 @@ func createAdminKubeconfig(clusterDir, controllerIP string) error {
 	return nil
 }
 
-func createClientKubeconfig(clusterDir, remoteIP string) error {
+// createAPIServerCert issues the API server certificate for a controller at
+// controllerIP, valid for the names an exposed API server is reached by too.
+func createAPIServerCert(state config.ClusterState, certDir, controllerIP, hostname string) error {
+	hostnames := "10.32.0.1," + controllerIP + ",127.0.0.1," + hostname
+	if state.Expose.APIPort != 0 {
+		hostnames += "," + strings.Join(append(state.Expose.Hosts, state.Expose.APIHost(hostname)), ",")
+	}
+
+	return certificates.CreateCert(certs.CertConfig{
+		Name: "kubernetes",
+		CN:   "kubernetes",
+		CA: certs.CAConfig{
+			Name: "ca",
+			Dir:  certDir,
+			CN:   "Kubernetes",
+		},
+		Dir:          certDir,
+		CAConfigPath: path.Join(certDir, "ca-config.json"),
+		ExtraOpts: map[string]string{
+			"hostname": hostnames,
+		},
+	})
+}
+
+// clientServer returns the host:port client.kubeconfig reaches the API
+// server at: its exposed port on the LXD host if there is one, otherwise
+// the controller, or the LXD remote if useRemoteIP is set.
+func clientServer(state config.ClusterState, controllerIP, hostname string, useRemoteIP bool) string {
+	switch {
+	case state.Expose.APIPort != 0:
+		return net.JoinHostPort(state.Expose.APIHost(hostname), strconv.Itoa(state.Expose.APIPort))
+	case useRemoteIP:
+		return net.JoinHostPort(hostname, "6443")
+	default:
+		return net.JoinHostPort(controllerIP, "6443")
+	}
+}
+
+func createClientKubeconfig(clusterDir, server string) error {
 	certDir := path.Join(clusterDir, "certificates")
 	kfgDir := path.Join(clusterDir, "kubeconfigs")
 
@@ -811,7 +1125,7 @@ func createClientKubeconfig(clusterDir, remoteIP string) error {
 		"lxdk",
 		"--certificate-authority="+path.Join(certDir, "ca.pem"),
 		"--embed-certs=true",
-		"--server=https://"+remoteIP+":6443",
+		"--server=https://"+server,
 		"--kubeconfig="+path.Join(kfgDir, "client.kubeconfig"),
 	).CombinedOutput()
 	if err != nil {
@@ -1,21 +1,28 @@
 package main
 
 import (
+	"context"
 	"crypto/x509"
 	"encoding/pem"
 	"flag"
+	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/greymatter-io/lxdk/config"
 	"github.com/greymatter-io/lxdk/containers"
 	"github.com/greymatter-io/lxdk/lxd"
 	"github.com/greymatter-io/lxdk/testutils"
+	lxdclient "github.com/lxc/lxd/client"
+	"github.com/lxc/lxd/shared/api"
 	"github.com/urfave/cli/v2"
 )
 
@@ -117,13 +124,13 @@ func TestCertificatesCreated(t *testing.T) {
 	var workerName string
 	for _, container := range state.Containers {
 		if strings.Contains(container, "etcd") {
-			etcdIP, err = containers.WaitContainerIP(container, nil, is)
+			etcdIP, err = containers.WaitContainerIP(context.Background(), container, nil, is)
 		}
 		if strings.Contains(container, "controller") {
-			controllerIP, err = containers.WaitContainerIP(container, nil, is)
+			controllerIP, err = containers.WaitContainerIP(context.Background(), container, nil, is)
 		}
 		if strings.Contains(container, "worker") {
-			workerIP, err = containers.WaitContainerIP(container, nil, is)
+			workerIP, err = containers.WaitContainerIP(context.Background(), container, nil, is)
 			workerName = container
 		}
 		if err != nil {
@@ -203,3 +210,80 @@ func testHostnames(certPath string, hostnames []string, t *testing.T) {
 		}
 	}
 }
+
+// fakeNodeServer records the commands run and files written in containers,
+// running every command successfully.
+type fakeNodeServer struct {
+	lxdclient.InstanceServer
+	mu       sync.Mutex
+	commands []string
+	files    []string
+}
+
+func (s *fakeNodeServer) ExecInstance(name string, req api.InstanceExecPost, args *lxdclient.InstanceExecArgs) (lxdclient.Operation, error) {
+	s.mu.Lock()
+	s.commands = append(s.commands, strings.Join(req.Command, " "))
+	s.mu.Unlock()
+
+	close(args.DataDone)
+	return fakeDoneOperation{}, nil
+}
+
+func (s *fakeNodeServer) GetInstanceFile(name, path string) (io.ReadCloser, *lxdclient.InstanceFileResponse, error) {
+	return nil, nil, api.StatusErrorf(http.StatusNotFound, "not found")
+}
+
+func (s *fakeNodeServer) CreateInstanceFile(name, path string, args lxdclient.InstanceFileArgs) error {
+	s.mu.Lock()
+	s.files = append(s.files, path)
+	s.mu.Unlock()
+
+	return nil
+}
+
+// fakeDoneOperation is an exec operation that has exited successfully.
+type fakeDoneOperation struct {
+	lxdclient.Operation
+}
+
+func (fakeDoneOperation) Wait() error { return nil }
+
+func (fakeDoneOperation) Get() api.Operation {
+	return api.Operation{Metadata: map[string]interface{}{"return": float64(0)}}
+}
+
+// TestNodeCommandsUseNoHostPaths checks that the commands run in nodes when
+// a cluster is restarted don't refer to the cache directory, which only
+// exists on the host.
+func TestNodeCommandsUseNoHostPaths(t *testing.T) {
+	cacheDir, cleanup, err := testutils.TempDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	flags := flag.NewFlagSet("testflags", flag.ContinueOnError)
+	flags.Int("parallelism", 2, "")
+	flags.Duration("api-timeout", time.Second, "")
+	flags.Duration("node-timeout", time.Second, "")
+	ctx := cli.NewContext(cli.NewApp(), flags, nil)
+
+	state := config.ClusterState{
+		Name:                    "test",
+		ControllerContainerName: "lxdk-test-controller-abcde",
+		WorkerContainerNames:    []string{"lxdk-test-worker-abcde"},
+	}
+	is := &fakeNodeServer{}
+
+	// there is no API server to wait for, so only the node setup succeeds
+	restartCluster(ctx, &state, cacheDir, is)
+
+	if len(is.commands) != 2 {
+		t.Fatalf("expected a command to run on each kubelet node, got %q", is.commands)
+	}
+	for _, command := range append(is.commands, is.files...) {
+		if strings.Contains(command, cacheDir) {
+			t.Errorf("%q refers to the cache directory %s", command, cacheDir)
+		}
+	}
+}
@@ -6,7 +6,6 @@ import (
 
 	"github.com/greymatter-io/lxdk/config"
 	"github.com/greymatter-io/lxdk/containers"
-	"github.com/greymatter-io/lxdk/lxd"
 	"github.com/urfave/cli/v2"
 )
 
@@ -33,7 +32,12 @@ func doStartWorker(ctx *cli.Context) error {
 		return fmt.Errorf("cluster %s is not running or was not started by lxdk", state.Name)
 	}
 
-	is, hostname, err := lxd.InstanceServerConnect()
+	is, hostname, err := connectCluster(ctx, state)
+	if err != nil {
+		return err
+	}
+
+	addresses, err := allocateAddresses(state, []string{config.RoleWorker}, is)
 	if err != nil {
 		return err
 	}
@@ -43,32 +47,51 @@ func doStartWorker(ctx *cli.Context) error {
 		ClusterName: state.Name,
 		StoragePool: state.StoragePool,
 		NetworkID:   state.NetworkID,
+		Profile:     state.Profile,
+		Image:       state.Images[config.RoleWorker],
+		IPv4:        addresses[config.RoleWorker],
+	}
+
+	containerName, err := containers.CreateContainer(ctx.Context, conf, is)
+	if err != nil {
+		return err
 	}
 
-	containerName, err := containers.CreateContainer(conf, is)
+	err = attachDevices(ctx, []config.Node{{Name: containerName, Role: config.RoleWorker}}, is)
 	if err != nil {
 		return err
 	}
 
-	if err := containers.StartContainer(containerName, is); err != nil {
+	for _, m := range state.Mounts {
+		if err := containers.AddDiskMount(containerName, m.Source, m.Path, m.ReadOnly, is); err != nil {
+			return err
+		}
+	}
+
+	if err := containers.StartContainer(ctx.Context, containerName, is); err != nil {
 		return err
 	}
 
-	if err = createWorkerCert(containerName, certDir, hostname, is); err != nil {
+	if err = createWorkerCert(ctx, containerName, certDir, hostname, is); err != nil {
+		return err
+	}
+
+	registryIP, err := waitIP(ctx, state.RegistryContainerName, hostname, is)
+	if err != nil {
 		return err
 	}
 
-	registryIP, err := containers.WaitContainerIP(state.RegistryContainerName, []string{hostname}, is)
+	controllerIP, err := waitIP(ctx, state.ControllerContainerName, hostname, is)
 	if err != nil {
 		return err
 	}
 
-	controllerIP, err := containers.WaitContainerIP(state.ControllerContainerName, []string{hostname}, is)
+	etcdIP, err := waitIP(ctx, state.EtcdContainerName, hostname, is)
 	if err != nil {
 		return err
 	}
 
-	etcdIP, err := containers.WaitContainerIP(state.EtcdContainerName, []string{hostname}, is)
+	err = createKubeProxyKubeconfig(controllerIP.String(), path.Join(cacheDir, state.Name))
 	if err != nil {
 		return err
 	}
@@ -80,14 +103,38 @@ func doStartWorker(ctx *cli.Context) error {
 		RegistryIP:    registryIP.String(),
 		EtcdIP:        etcdIP.String(),
 		ClusterDir:    path.Join(cacheDir, state.Name),
+		CgroupMode:    state.CgroupMode,
+		Unprivileged:  state.Unprivileged,
 	}
-	err = configureWorker(containerConfig, is)
+	err = configureWorker(ctx, containerConfig, is)
+	if err != nil {
+		return err
+	}
+
+	imageRef := containers.ImageAlias(config.RoleWorker)
+	if workers := state.NodesWithRole(config.RoleWorker); len(workers) > 0 {
+		imageRef = workers[0].ImageAlias
+	}
+	node, err := newNode(containerName, config.RoleWorker, imageRef, is)
+	if err != nil {
+		return err
+	}
+
+	ip, err := waitIP(ctx, containerName, hostname, is)
+	if err != nil {
+		return err
+	}
+	node.IP = ip.String()
+	node.StaticIP = addresses[config.RoleWorker]
+
+	node.MAC, err = containers.GetContainerMAC(containerName, is)
 	if err != nil {
 		return err
 	}
 
 	state.Containers = append(state.Containers, containerName)
 	state.WorkerContainerNames = append(state.WorkerContainerNames, containerName)
+	state.SetNode(node)
 	if err := config.WriteClusterState(ctx, state); err != nil {
 		return err
 	}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"strings"
+	"time"
 
 	"github.com/greymatter-io/lxdk/config"
 	"github.com/greymatter-io/lxdk/containers"
-	"github.com/greymatter-io/lxdk/lxd"
 	"github.com/urfave/cli/v2"
 )
 
@@ -14,6 +16,12 @@ var (
 		Name:   "stop",
 		Usage:  "stop a cluster",
 		Action: doStop,
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:  "force",
+				Usage: "stop every node without checking which are running, ignoring nodes that can't be stopped",
+			},
+		},
 	}
 )
 
@@ -23,23 +31,45 @@ func doStop(ctx *cli.Context) error {
 		return err
 	}
 
-  // TODO(cm): do we actually check with the real api?
-	if state.RunState == config.Stopped {
-		return fmt.Errorf("cluster %s is already stopped or was not started by lxdk", state.Name)
-	}
-
-	is, _, err := lxd.InstanceServerConnect()
+	is, _, err := connectCluster(ctx, state)
 	if err != nil {
 		return err
 	}
 
-	for _, container := range state.Containers {
-		if err := containers.StopContainer(container, is); err != nil {
+	if ctx.Bool("force") {
+		// LXD isn't asked which nodes are running, so that a cluster it
+		// reports wrongly can still be stopped
+		for _, container := range state.Containers {
+			if err := containers.StopContainer(container, is); err != nil {
+				log.Default().Printf("could not stop %s: %s", container, err)
+			}
+		}
+	} else {
+		status, err := reconcileState(&state, is)
+		if err != nil {
 			return err
 		}
+		if err := config.WriteClusterState(ctx, state); err != nil {
+			return err
+		}
+
+		if len(status.Running) == 0 {
+			return fmt.Errorf("cluster %s is already stopped, use --force to stop it anyway", state.Name)
+		}
+
+		if len(status.Missing) > 0 {
+			log.Default().Printf("skipping missing nodes: %s", strings.Join(status.Missing, ", "))
+		}
+
+		for _, container := range status.Running {
+			if err := containers.StopContainer(container, is); err != nil {
+				return err
+			}
+		}
 	}
 
 	state.RunState = config.Stopped
+	state.StoppedAt = time.Now().UTC()
 	if err := config.WriteClusterState(ctx, state); err != nil {
 		return err
 	}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/greymatter-io/lxdk/containers"
+	lxdclient "github.com/lxc/lxd/client"
+	"github.com/urfave/cli/v2"
+)
+
+// phaseContext returns a context for one phase of provisioning, which ends
+// after the duration of the global timeout flag named flag or when lxdk is
+// interrupted.
+func phaseContext(ctx *cli.Context, flag string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx.Context, ctx.Duration(flag))
+}
+
+// waitIP waits up to --ip-timeout for container to get an address that
+// isn't hostname's.
+func waitIP(ctx *cli.Context, container, hostname string, is lxdclient.InstanceServer) (net.IP, error) {
+	wctx, cancel := phaseContext(ctx, "ip-timeout")
+	defer cancel()
+
+	return containers.WaitContainerIP(wctx, container, []string{hostname}, is)
+}
+
+// interrupted returns an error if lxdk has been interrupted. Work that can't
+// be cancelled midway checks it between steps.
+func interrupted(ctx *cli.Context) error {
+	if err := ctx.Context.Err(); err != nil {
+		return fmt.Errorf("interrupted: %w", err)
+	}
+
+	return nil
+}
@@ -1,11 +1,22 @@
 package main
 
-import "github.com/urfave/cli/v2"
+import (
+	"log"
+	"path"
+
+	"github.com/greymatter-io/lxdk/config"
+	"github.com/urfave/cli/v2"
+)
 
 var upCmd = &cli.Command{
-	Name:   "up",
-	Usage:  "create + start in one command",
-	Flags:  append(createCmd.Flags, startCmd.Flags...),
+	Name:  "up",
+	Usage: "create + start in one command",
+	Flags: append(mergeFlags(createCmd.Flags, startCmd.Flags),
+		&cli.BoolFlag{
+			Name:  "rollback",
+			Usage: "delete the cluster again if it fails to start, instead of keeping it marked as failed",
+		},
+	),
 	Action: doUp,
 }
 
@@ -16,9 +27,52 @@ func doUp(ctx *cli.Context) error {
 	}
 
 	err = doStart(ctx)
+	if err != nil && ctx.Bool("rollback") {
+		log.Default().Printf("start failed, deleting cluster: %s", err)
+		if rerr := rollbackCluster(ctx, ctx.Args().First()); rerr != nil {
+			log.Default().Printf("could not delete cluster: %s", rerr)
+		}
+	}
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// rollbackCluster deletes a cluster that was just created, along with its
+// storage pool and network unless existing ones were given to create.
+func rollbackCluster(ctx *cli.Context, clusterName string) error {
+	cacheDir := ctx.String("cache")
+	state, err := config.LoadClusterState(cacheDir, clusterName)
+	if err != nil {
+		return err
+	}
+
+	is, _, err := connectCluster(ctx, state)
+	if err != nil {
+		return err
+	}
+
+	return deleteCluster(state, path.Join(cacheDir, clusterName), ctx.String("storage-pool") == "", ctx.String("network") == "", is)
+}
+
+// mergeFlags returns the flags of every set, dropping flags whose name was
+// already taken by an earlier set, so flags shared by create and start are
+// only defined once on up.
+func mergeFlags(sets ...[]cli.Flag) []cli.Flag {
+	var flags []cli.Flag
+	seen := make(map[string]bool)
+	for _, set := range sets {
+		for _, flag := range set {
+			name := flag.Names()[0]
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			flags = append(flags, flag)
+		}
+	}
+
+	return flags
+}
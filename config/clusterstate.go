@@ -1,30 +1,109 @@
 package config
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli/v2"
 )
 
+// CurrentStateVersion is the schema version of state.toml written by this
+// build of lxdk. Bump it and append a migration to migrations whenever
+// ClusterState changes in a way older state files can't be decoded into.
+const CurrentStateVersion = 4
+
 type RunState int
 
 const (
 	Uninitialized RunState = iota
 	Running
 	Stopped
+	// Degraded clusters have some nodes running and others stopped or
+	// missing, or were never completely started.
+	Degraded
+	// Failed clusters were being provisioned when start failed or was
+	// cancelled. Starting them again provisions them from the beginning.
+	Failed
 )
 
+func (r RunState) String() string {
+	switch r {
+	case Uninitialized:
+		return "uninitialized"
+	case Running:
+		return "running"
+	case Stopped:
+		return "stopped"
+	case Degraded:
+		return "degraded"
+	case Failed:
+		return "failed"
+	}
+	return fmt.Sprintf("unknown (%d)", int(r))
+}
+
+// Node roles. Each role is launched from its own image, except the registry
+// which uses the worker image.
+const (
+	RoleEtcd       = "etcd"
+	RoleController = "controller"
+	RoleWorker     = "worker"
+	RoleRegistry   = "registry"
+)
+
+// Node is a single LXD instance belonging to a cluster. IP and MAC are
+// recorded when the cluster is started. StaticIP is the address allocated
+// to the node when it was created, empty if it gets one by DHCP.
+type Node struct {
+	Name             string `toml:"name"`
+	Role             string `toml:"role"`
+	IP               string `toml:"ip"`
+	MAC              string `toml:"mac"`
+	StaticIP         string `toml:"static_ip"`
+	ImageAlias       string `toml:"image_alias"`
+	ImageFingerprint string `toml:"image_fingerprint"`
+}
+
+// Snapshot is a snapshot taken of every node of a cluster under one name.
+// RunState is the state the cluster was in when it was taken, which restoring
+// the snapshot returns the cluster to, and Provisioned whether it had been
+// provisioned.
+type Snapshot struct {
+	Name        string    `toml:"name"`
+	RunState    RunState  `toml:"run_state"`
+	Provisioned bool      `toml:"provisioned"`
+	CreatedAt   time.Time `toml:"created_at"`
+}
+
 type ClusterState struct {
+	Version int `toml:"version"`
+
 	Name      string `toml:"name"`
 	NetworkID string `toml:"network_id"`
 
+	// Remote is the lxc remote and Project the LXD project the cluster
+	// lives in. An empty Remote is the default remote of the lxc client.
+	Remote  string `toml:"remote"`
+	Project string `toml:"project"`
+
 	Containers []string `toml:"containers"`
 
 	RunState RunState `toml:"run_state"`
 
+	// Provisioned is set once the cluster has been started successfully.
+	// Starting a provisioned cluster only starts its nodes and checks
+	// they are ready, instead of provisioning them from the beginning.
+	Provisioned bool `toml:"provisioned"`
+
 	EtcdContainerName       string   `toml:"etcd_container_name"`
 	ControllerContainerName string   `toml:"controller_container_name"`
 	RegistryContainerName   string   `toml:"registry_container_name"`
@@ -32,22 +111,213 @@ type ClusterState struct {
 
 	StorageDriver string `toml:"storage_driver"`
 	StoragePool   string `toml:"storage_pool"`
+
+	// CgroupMode is the cgroup hierarchy the nodes run under, "v1" or
+	// "v2", and Profile the LXD profile applied to non-etcd nodes for it.
+	CgroupMode string `toml:"cgroup_mode"`
+	Profile    string `toml:"profile"`
+
+	// Unprivileged nodes run in user namespaces with an isolated idmap
+	// instead of as privileged containers
+	Unprivileged bool `toml:"unprivileged"`
+
+	Nodes []Node `toml:"nodes"`
+
+	Snapshots []Snapshot `toml:"snapshots"`
+
+	// Mounts are host directories mounted into nodes when they start
+	Mounts []Mount `toml:"mounts"`
+
+	// Expose records the cluster ports published on the LXD host
+	Expose Expose `toml:"expose"`
+
+	// Images are the fingerprints of the images each role is launched
+	// from, resolved when the cluster was created.
+	Images map[string]string `toml:"images"`
+
+	KubernetesVersion string            `toml:"kubernetes_version"`
+	ComponentVersions map[string]string `toml:"component_versions"`
+
+	// LXDKVersion is the version of lxdk that created the cluster and
+	// CreateFlags the flags it was created with.
+	LXDKVersion string            `toml:"lxdk_version"`
+	CreateFlags map[string]string `toml:"create_flags"`
+
+	CreatedAt time.Time `toml:"created_at"`
+	StartedAt time.Time `toml:"started_at"`
+	StoppedAt time.Time `toml:"stopped_at"`
 }
 
-func ClusterStateFromContext(ctx *cli.Context) (ClusterState, error) {
-	var state ClusterState
+// Node returns the node named name.
+func (s ClusterState) Node(name string) (Node, bool) {
+	for _, n := range s.Nodes {
+		if n.Name == name {
+			return n, true
+		}
+	}
+
+	return Node{}, false
+}
+
+// SetNode replaces the node with the same name as n, or adds n if the
+// cluster has no such node.
+func (s *ClusterState) SetNode(n Node) {
+	for i := range s.Nodes {
+		if s.Nodes[i].Name == n.Name {
+			s.Nodes[i] = n
+			return
+		}
+	}
+
+	s.Nodes = append(s.Nodes, n)
+}
+
+// NodesWithRole returns every node with the given role, in creation order.
+func (s ClusterState) NodesWithRole(role string) []Node {
+	var nodes []Node
+	for _, n := range s.Nodes {
+		if n.Role == role {
+			nodes = append(nodes, n)
+		}
+	}
+
+	return nodes
+}
+
+// Snapshot returns the cluster snapshot named name.
+func (s ClusterState) Snapshot(name string) (Snapshot, bool) {
+	for _, snap := range s.Snapshots {
+		if snap.Name == name {
+			return snap, true
+		}
+	}
+
+	return Snapshot{}, false
+}
+
+// RemoveSnapshot forgets the cluster snapshot named name.
+func (s *ClusterState) RemoveSnapshot(name string) {
+	kept := s.Snapshots[:0]
+	for _, snap := range s.Snapshots {
+		if snap.Name != name {
+			kept = append(kept, snap)
+		}
+	}
+	s.Snapshots = kept
+}
+
+// ResolveNodes returns the container names a node selector refers to. A
+// selector is a role (etcd, controller, registry, or worker for every
+// worker), a numbered worker such as worker-2, "all", or a container name.
+func (s ClusterState) ResolveNodes(selector string) ([]string, error) {
+	switch selector {
+	case "all":
+		return s.Containers, nil
+	case RoleEtcd:
+		return nonEmpty(s.EtcdContainerName, selector)
+	case RoleController:
+		return nonEmpty(s.ControllerContainerName, selector)
+	case RoleRegistry:
+		return nonEmpty(s.RegistryContainerName, selector)
+	case RoleWorker, "workers":
+		if len(s.WorkerContainerNames) == 0 {
+			return nil, errors.Errorf("cluster %s has no workers", s.Name)
+		}
+		return s.WorkerContainerNames, nil
+	}
+
+	if strings.HasPrefix(selector, RoleWorker+"-") {
+		n, err := strconv.Atoi(strings.TrimPrefix(selector, RoleWorker+"-"))
+		if err == nil {
+			if n < 1 || n > len(s.WorkerContainerNames) {
+				return nil, errors.Errorf("cluster %s has %d workers, there is no %s", s.Name, len(s.WorkerContainerNames), selector)
+			}
+			return []string{s.WorkerContainerNames[n-1]}, nil
+		}
+	}
 
+	for _, name := range s.Containers {
+		if name == selector {
+			return []string{name}, nil
+		}
+	}
+
+	return nil, errors.Errorf("unknown node %s, must be etcd, controller, registry, worker, worker-<n>, all or a container name", selector)
+}
+
+func nonEmpty(name, role string) ([]string, error) {
+	if name == "" {
+		return nil, errors.Errorf("cluster has no %s node", role)
+	}
+
+	return []string{name}, nil
+}
+
+func ClusterStateFromContext(ctx *cli.Context) (ClusterState, error) {
 	clusterName := ctx.Args().First()
 	if clusterName == "" {
-		return state, errors.New("must supply cluster name")
+		return ClusterState{}, errors.New("must supply cluster name")
+	}
+
+	return LoadClusterState(ctx.String("cache"), clusterName)
+}
+
+// LoadClusterState reads the state.toml of clusterName from cacheDir. State
+// written by an older lxdk is backed up, migrated to CurrentStateVersion and
+// written back; state written by a newer lxdk is refused.
+func LoadClusterState(cacheDir, clusterName string) (ClusterState, error) {
+	var state ClusterState
+
+	clusterConfigPath := path.Join(cacheDir, clusterName, "state.toml")
+	data, err := ioutil.ReadFile(clusterConfigPath)
+	if err != nil {
+		return state, errors.Wrap(err, "error loading config file")
+	}
+
+	raw := make(map[string]interface{})
+	if _, err := toml.Decode(string(data), &raw); err != nil {
+		return state, errors.Wrap(err, "error loading config file")
 	}
 
-	clusterConfigPath := path.Join(ctx.String("cache"), clusterName, "state.toml")
-	_, err := toml.DecodeFile(clusterConfigPath, &state)
+	version, err := stateVersion(raw)
 	if err != nil {
+		return state, errors.Wrapf(err, "error loading config file %s", clusterConfigPath)
+	}
+
+	if version > CurrentStateVersion {
+		return state, errors.Errorf("state for cluster %s has schema version %d, but this lxdk only supports up to version %d; upgrade lxdk to manage this cluster",
+			clusterName, version, CurrentStateVersion)
+	}
+
+	backupPath := fmt.Sprintf("%s.v%d.bak", clusterConfigPath, version)
+	if version < CurrentStateVersion {
+		if err := ioutil.WriteFile(backupPath, data, 0600); err != nil {
+			return state, errors.Wrap(err, "error backing up state before migration")
+		}
+
+		if err := migrateState(raw, version); err != nil {
+			return state, errors.Wrapf(err, "error migrating state for cluster %s", clusterName)
+		}
+
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(raw); err != nil {
+			return state, errors.Wrap(err, "error encoding migrated state")
+		}
+		data = buf.Bytes()
+	}
+
+	if _, err := toml.Decode(string(data), &state); err != nil {
 		return state, errors.Wrap(err, "error loading config file")
 	}
 
+	if version < CurrentStateVersion {
+		if err := SaveClusterState(cacheDir, state); err != nil {
+			return state, errors.Wrap(err, "error writing migrated state")
+		}
+		log.Default().Printf("migrated state for cluster %s from version %d to %d, backup written to %s",
+			clusterName, version, CurrentStateVersion, backupPath)
+	}
+
 	return state, nil
 }
 
@@ -56,18 +326,32 @@ func WriteClusterState(ctx *cli.Context, state ClusterState) error {
 	if clusterName == "" {
 		return errors.New("must supply cluster name")
 	}
+	state.Name = clusterName
+
+	return SaveClusterState(ctx.String("cache"), state)
+}
+
+// SaveClusterState writes state to the state.toml of the cluster named by
+// state.Name in cacheDir, stamped with CurrentStateVersion.
+func SaveClusterState(cacheDir string, state ClusterState) error {
+	if state.Name == "" {
+		return errors.New("must supply cluster name")
+	}
 
-	cacheDir := path.Join(ctx.String("cache"), clusterName)
+	cacheDir = path.Join(cacheDir, state.Name)
 	err := os.MkdirAll(cacheDir, 0777)
 	if err != nil {
 		return errors.Wrap(err, "error creating "+cacheDir)
 	}
 
+	state.Version = CurrentStateVersion
+
 	clusterConfigPath := path.Join(cacheDir, "state.toml")
 	w, err := os.Create(clusterConfigPath)
 	if err != nil {
 		return err
 	}
+	defer w.Close()
 
 	enc := toml.NewEncoder(w)
 	err = enc.Encode(state)
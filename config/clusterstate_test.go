@@ -0,0 +1,231 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/greymatter-io/lxdk/testutils"
+)
+
+// TestLoadClusterStateMigrates checks that an unversioned state file is
+// backed up, migrated and rewritten at the current version.
+func TestLoadClusterStateMigrates(t *testing.T) {
+	tmpDir, cleanup, err := testutils.TempDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	legacy := `name = "test"
+network_id = "lxdk-test"
+containers = ["lxdk-test-etcd-abcde"]
+run_state = 2
+etcd_container_name = "lxdk-test-etcd-abcde"
+storage_pool = "lxdk-test"
+`
+	writeState(t, tmpDir, "test", legacy)
+
+	state, err := LoadClusterState(tmpDir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state.Version != CurrentStateVersion {
+		t.Fatalf("expected version %d, got %d", CurrentStateVersion, state.Version)
+	}
+	if state.EtcdContainerName != "lxdk-test-etcd-abcde" || state.RunState != Stopped {
+		t.Fatalf("fields were not preserved by migration: %+v", state)
+	}
+	if state.CgroupMode != "v1" || state.Profile != "lxdk" {
+		t.Fatalf("legacy clusters should use the v1 profile, got %s/%s", state.CgroupMode, state.Profile)
+	}
+	if node, ok := state.Node("lxdk-test-etcd-abcde"); !ok || node.Role != RoleEtcd {
+		t.Fatalf("etcd node was not migrated: %+v", state.Nodes)
+	}
+
+	backup, err := ioutil.ReadFile(path.Join(tmpDir, "test", "state.toml.v0.bak"))
+	if err != nil {
+		t.Fatal("backup was not written:", err)
+	}
+	if string(backup) != legacy {
+		t.Fatal("backup does not match the original state file")
+	}
+
+	reloaded, err := LoadClusterState(tmpDir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Version != CurrentStateVersion {
+		t.Fatalf("migrated state was not written back, got version %d", reloaded.Version)
+	}
+}
+
+// TestMigrateProvisioned checks that clusters that have started successfully
+// are marked provisioned, and failed ones are not.
+func TestMigrateProvisioned(t *testing.T) {
+	tmpDir, cleanup, err := testutils.TempDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	tests := map[string]struct {
+		state string
+		want  bool
+	}{
+		"stopped": {
+			state: "run_state = 2\ncreated_at = 2022-03-01T10:00:00Z\nstarted_at = 2022-03-01T10:05:00Z\n",
+			want:  true,
+		},
+		"never-started": {
+			state: "run_state = 2\ncreated_at = 2022-03-01T10:00:00Z\nstarted_at = 0001-01-01T00:00:00Z\n",
+			want:  false,
+		},
+		"failed": {
+			state: "run_state = 4\ncreated_at = 2022-03-01T10:00:00Z\nstarted_at = 2022-03-01T10:05:00Z\n",
+			want:  false,
+		},
+	}
+
+	for name, tt := range tests {
+		snapshots := `
+[[snapshots]]
+name = "running"
+run_state = 1
+
+[[snapshots]]
+name = "uninitialized"
+run_state = 0
+`
+		writeState(t, tmpDir, name, "version = 3\nname = \""+name+"\"\n"+tt.state+snapshots)
+
+		state, err := LoadClusterState(tmpDir, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Provisioned != tt.want {
+			t.Errorf("%s: provisioned = %t, want %t", name, state.Provisioned, tt.want)
+		}
+		if running, _ := state.Snapshot("running"); !running.Provisioned {
+			t.Errorf("%s: snapshot of a running cluster is not provisioned", name)
+		}
+		if uninitialized, _ := state.Snapshot("uninitialized"); uninitialized.Provisioned {
+			t.Errorf("%s: snapshot of an uninitialized cluster is provisioned", name)
+		}
+	}
+}
+
+// TestLoadClusterStateRefusesNewer checks that state written by a newer lxdk
+// is not decoded.
+func TestLoadClusterStateRefusesNewer(t *testing.T) {
+	tmpDir, cleanup, err := testutils.TempDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	writeState(t, tmpDir, "test", "version = 999\nname = \"test\"\n")
+
+	if _, err := LoadClusterState(tmpDir, "test"); err == nil {
+		t.Fatal("expected an error loading state with a newer schema version")
+	}
+}
+
+func writeState(t *testing.T, cacheDir, name, data string) {
+	err := os.MkdirAll(path.Join(cacheDir, name), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(path.Join(cacheDir, name, "state.toml"), []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestResolveNodes checks that node selectors resolve to the right
+// containers.
+func TestResolveNodes(t *testing.T) {
+	state := ClusterState{
+		Name:                    "test",
+		Containers:              []string{"lxdk-test-etcd-a", "lxdk-test-controller-b", "lxdk-test-registry-c", "lxdk-test-worker-d", "lxdk-test-worker-e"},
+		EtcdContainerName:       "lxdk-test-etcd-a",
+		ControllerContainerName: "lxdk-test-controller-b",
+		RegistryContainerName:   "lxdk-test-registry-c",
+		WorkerContainerNames:    []string{"lxdk-test-worker-d", "lxdk-test-worker-e"},
+	}
+
+	cases := map[string][]string{
+		"etcd":               {"lxdk-test-etcd-a"},
+		"controller":         {"lxdk-test-controller-b"},
+		"worker":             {"lxdk-test-worker-d", "lxdk-test-worker-e"},
+		"worker-2":           {"lxdk-test-worker-e"},
+		"lxdk-test-worker-d": {"lxdk-test-worker-d"},
+		"all":                state.Containers,
+	}
+	for selector, expected := range cases {
+		got, err := state.ResolveNodes(selector)
+		if err != nil {
+			t.Fatalf("%s: %s", selector, err)
+		}
+		if strings.Join(got, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s: expected %v, got %v", selector, expected, got)
+		}
+	}
+
+	for _, selector := range []string{"worker-0", "worker-3", "kubelet"} {
+		if _, err := state.ResolveNodes(selector); err == nil {
+			t.Errorf("%s: expected an error", selector)
+		}
+	}
+}
+
+func TestRemoveSnapshot(t *testing.T) {
+	state := ClusterState{Snapshots: []Snapshot{{Name: "a"}, {Name: "b"}, {Name: "c"}}}
+	state.RemoveSnapshot("b")
+
+	if _, ok := state.Snapshot("b"); ok {
+		t.Error("snapshot b was not removed")
+	}
+	for _, name := range []string{"a", "c"} {
+		if _, ok := state.Snapshot(name); !ok {
+			t.Errorf("snapshot %s was removed", name)
+		}
+	}
+}
+
+// TestMigrateNodesOrder checks that nodes missing from containers are added
+// in the same order every time.
+func TestMigrateNodesOrder(t *testing.T) {
+	raw := map[string]interface{}{
+		"containers":                []interface{}{"lxdk-test-etcd-abcde"},
+		"etcd_container_name":       "lxdk-test-etcd-abcde",
+		"controller_container_name": "lxdk-test-controller-abcde",
+		"registry_container_name":   "lxdk-test-registry-abcde",
+		"worker_container_names":    []interface{}{"lxdk-test-worker-fghij", "lxdk-test-worker-abcde"},
+	}
+	want := []string{
+		"lxdk-test-etcd-abcde",
+		"lxdk-test-controller-abcde",
+		"lxdk-test-registry-abcde",
+		"lxdk-test-worker-abcde",
+		"lxdk-test-worker-fghij",
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := migrateV1ToV2(raw); err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, node := range raw["nodes"].([]map[string]interface{}) {
+			got = append(got, node["name"].(string))
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("expected nodes %v, got %v", want, got)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"os"
+
 	"github.com/BurntSushi/toml"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli/v2"
@@ -14,12 +16,59 @@ type Config struct {
 	StoragePool            string `toml:"storage_pool"`
 	RootFSSize             string `toml:"root_fs_size"`
 	EnableInsecureRegistry bool   `toml:"enable_insecure_registry"`
+
+	// Devices are the host devices passed through to the nodes of each
+	// role, keyed by role, e.g. [devices.worker]
+	Devices map[string]DeviceConfig `toml:"devices"`
+}
+
+// DeviceConfig lists the host devices passed through to a node. Devices are
+// looked up on the LXD server, not the machine lxdk runs on.
+type DeviceConfig struct {
+	// Loop is the number of /dev/loopN devices to pass through
+	Loop   int            `toml:"loop"`
+	Tun    bool           `toml:"tun"`
+	Fuse   bool           `toml:"fuse"`
+	KVM    bool           `toml:"kvm"`
+	Custom []CustomDevice `toml:"custom"`
+}
+
+// CustomDevice is any unix-char or unix-block device. Source is a path on
+// the LXD server or, for a unix-block device, the id of a disk the server
+// reports, e.g. sdb. Path defaults to Source. Devices that are not Required
+// are skipped while the server doesn't have them.
+type CustomDevice struct {
+	Name     string `toml:"name"`
+	Type     string `toml:"type"`
+	Source   string `toml:"source"`
+	Path     string `toml:"path"`
+	Required bool   `toml:"required"`
+}
+
+// defaultDevices are passed through to nodes that run a kubelet unless the
+// config file says otherwise.
+var defaultDevices = DeviceConfig{Loop: 8, Tun: true}
+
+// RoleDevices returns the devices passed through to nodes of role.
+func (c Config) RoleDevices(role string) DeviceConfig {
+	if devices, ok := c.Devices[role]; ok {
+		return devices
+	}
+
+	switch role {
+	case RoleWorker, RoleController:
+		return defaultDevices
+	default:
+		return DeviceConfig{}
+	}
 }
 
+// CLIConfigFromCLIContext reads the config file given by the config flag. A
+// missing config file is the same as an empty one.
 func CLIConfigFromCLIContext(context *cli.Context) (Config, error) {
 	var conf Config
 	_, err := toml.DecodeFile(context.String("config"), &conf)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return conf, errors.Wrap(err, "error loading config file")
 	}
 
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestRoleDevices(t *testing.T) {
+	var conf Config
+	_, err := toml.Decode(`
+[devices.worker]
+loop = 4
+fuse = true
+
+[[devices.worker.custom]]
+type = "unix-block"
+source = "sdb"
+path = "/dev/data"
+
+[devices.etcd]
+`, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	worker := DeviceConfig{
+		Loop: 4,
+		Fuse: true,
+		Custom: []CustomDevice{
+			{Type: "unix-block", Source: "sdb", Path: "/dev/data"},
+		},
+	}
+	tests := map[string]DeviceConfig{
+		RoleWorker:     worker,
+		RoleController: defaultDevices,
+		RoleEtcd:       {},
+		RoleRegistry:   {},
+	}
+
+	for role, want := range tests {
+		if got := conf.RoleDevices(role); !reflect.DeepEqual(got, want) {
+			t.Errorf("RoleDevices(%s) = %+v, want %+v", role, got, want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultExposeAddress is the LXD host address exposed ports listen on
+// unless another is given.
+const DefaultExposeAddress = "0.0.0.0"
+
+// Expose records the ports of a cluster published on the LXD host with
+// proxy devices. APIPort is zero if the API server isn't exposed.
+type Expose struct {
+	// Address is the LXD host address the proxies listen on
+	Address string `toml:"address"`
+	// Hosts are the names clients reach the LXD host by, added to the API
+	// server certificate
+	Hosts     []string   `toml:"hosts"`
+	APIPort   int        `toml:"api_port"`
+	NodePorts []NodePort `toml:"node_ports"`
+}
+
+// NodePort publishes a Kubernetes NodePort on HostPort of the LXD host.
+type NodePort struct {
+	NodePort int `toml:"node_port"`
+	HostPort int `toml:"host_port"`
+}
+
+// ParseNodePort parses a NodePort given as nodeport[:hostport]. The host
+// port defaults to the NodePort.
+func ParseNodePort(spec string) (NodePort, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) > 2 {
+		return NodePort{}, errors.Errorf("invalid nodeport %s, must be nodeport[:hostport]", spec)
+	}
+
+	var ports []int
+	for _, part := range parts {
+		port, err := strconv.Atoi(part)
+		if err != nil || port < 1 || port > 65535 {
+			return NodePort{}, errors.Errorf("invalid nodeport %s, %q is not a port", spec, part)
+		}
+		ports = append(ports, port)
+	}
+
+	np := NodePort{NodePort: ports[0], HostPort: ports[0]}
+	if len(ports) == 2 {
+		np.HostPort = ports[1]
+	}
+
+	return np, nil
+}
+
+// Exposed returns true if any port is published.
+func (e Expose) Exposed() bool {
+	return e.APIPort != 0 || len(e.NodePorts) > 0
+}
+
+// ListenAddress returns the LXD host address the proxies listen on.
+func (e Expose) ListenAddress() string {
+	if e.Address == "" {
+		return DefaultExposeAddress
+	}
+
+	return e.Address
+}
+
+// SetNodePort replaces the NodePort published for np.NodePort, or adds np.
+func (e *Expose) SetNodePort(np NodePort) {
+	for i := range e.NodePorts {
+		if e.NodePorts[i].NodePort == np.NodePort {
+			e.NodePorts[i] = np
+			return
+		}
+	}
+
+	e.NodePorts = append(e.NodePorts, np)
+}
+
+// RemoveNodePort stops recording nodePort as published, returning false if
+// it wasn't.
+func (e *Expose) RemoveNodePort(nodePort int) bool {
+	for i, np := range e.NodePorts {
+		if np.NodePort == nodePort {
+			e.NodePorts = append(e.NodePorts[:i], e.NodePorts[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// APIHost returns the name clients reach an exposed API server by: the
+// first of Hosts, or a specific listen address, or else remoteHostname,
+// which is empty for a local LXD, in which case the loopback address.
+func (e Expose) APIHost(remoteHostname string) string {
+	switch {
+	case len(e.Hosts) > 0:
+		return e.Hosts[0]
+	case e.ListenAddress() != DefaultExposeAddress:
+		return e.ListenAddress()
+	case remoteHostname != "":
+		return remoteHostname
+	default:
+		return "127.0.0.1"
+	}
+}
@@ -0,0 +1,35 @@
+package config
+
+import "testing"
+
+func TestParseNodePort(t *testing.T) {
+	tests := []struct {
+		spec string
+		want NodePort
+		err  bool
+	}{
+		{spec: "30080", want: NodePort{NodePort: 30080, HostPort: 30080}},
+		{spec: "30080:8080", want: NodePort{NodePort: 30080, HostPort: 8080}},
+		{spec: "30080:", err: true},
+		{spec: "http", err: true},
+		{spec: "30080:8080:80", err: true},
+		{spec: "70000", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseNodePort(tt.spec)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseNodePort(%q) succeeded, want an error", tt.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseNodePort(%q): %s", tt.spec, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseNodePort(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package config
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// migration upgrades a decoded state.toml by exactly one schema version.
+// Migrations operate on the raw TOML document so they can read fields that
+// no longer exist on ClusterState.
+type migration func(raw map[string]interface{}) error
+
+// migrations[n] upgrades state from version n to version n+1, so
+// len(migrations) must always equal CurrentStateVersion.
+var migrations = []migration{
+	migrateV0ToV1,
+	migrateV1ToV2,
+	migrateV2ToV3,
+	migrateV3ToV4,
+}
+
+// stateVersion returns the schema version of a decoded state.toml. State
+// files written before versioning was introduced have no version key and are
+// version 0.
+func stateVersion(raw map[string]interface{}) (int, error) {
+	v, ok := raw["version"]
+	if !ok {
+		return 0, nil
+	}
+
+	version, ok := v.(int64)
+	if !ok || version < 0 {
+		return 0, errors.Errorf("invalid state version %v", v)
+	}
+
+	return int(version), nil
+}
+
+// migrateState applies every migration needed to bring raw from version from
+// up to CurrentStateVersion.
+func migrateState(raw map[string]interface{}, from int) error {
+	if len(migrations) != CurrentStateVersion {
+		return errors.Errorf("lxdk has %d state migrations but state version is %d", len(migrations), CurrentStateVersion)
+	}
+
+	for v := from; v < CurrentStateVersion; v++ {
+		if err := migrations[v](raw); err != nil {
+			return errors.Wrapf(err, "migration from version %d to %d failed", v, v+1)
+		}
+		raw["version"] = int64(v + 1)
+	}
+
+	return nil
+}
+
+// migrateV0ToV1 only introduces the version key; the fields of unversioned
+// state files are unchanged.
+func migrateV0ToV1(raw map[string]interface{}) error {
+	return nil
+}
+
+// migrateV1ToV2 builds the nodes table from the per-role container name
+// fields. Addresses and image details are unknown until the next start.
+func migrateV1ToV2(raw map[string]interface{}) error {
+	roles := map[string]string{}
+	for key, role := range map[string]string{
+		"etcd_container_name":       RoleEtcd,
+		"controller_container_name": RoleController,
+		"registry_container_name":   RoleRegistry,
+	} {
+		if name, ok := raw[key].(string); ok && name != "" {
+			roles[name] = role
+		}
+	}
+	for _, name := range rawStrings(raw["worker_container_names"]) {
+		roles[name] = RoleWorker
+	}
+
+	// names missing from containers are added in sorted order, so every
+	// migration of the same file gives the same result
+	var missing []string
+	names := rawStrings(raw["containers"])
+	for name := range roles {
+		if !containsString(names, name) {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	names = append(names, missing...)
+
+	var nodes []map[string]interface{}
+	for _, name := range names {
+		role, ok := roles[name]
+		if !ok {
+			role = roleFromName(name)
+		}
+		nodes = append(nodes, map[string]interface{}{
+			"name": name,
+			"role": role,
+		})
+	}
+	raw["nodes"] = nodes
+
+	return nil
+}
+
+// migrateV2ToV3 records the cgroup mode and profile of clusters created
+// before cgroup2 support, which always used the v1 "lxdk" profile.
+func migrateV2ToV3(raw map[string]interface{}) error {
+	if _, ok := raw["cgroup_mode"]; !ok {
+		raw["cgroup_mode"] = "v1"
+	}
+	if _, ok := raw["profile"]; !ok {
+		raw["profile"] = "lxdk"
+	}
+
+	return nil
+}
+
+// migrateV3ToV4 marks clusters that have been started successfully as
+// provisioned, so they restart quickly. Clusters that never started, such as
+// ones that failed the first time and were stopped, have no start time and
+// are provisioned again, as are clusters that are failed now. Snapshots taken
+// while a cluster was running are provisioned too.
+func migrateV3ToV4(raw map[string]interface{}) error {
+	if _, ok := raw["provisioned"]; !ok {
+		raw["provisioned"] = startedSinceCreated(raw) && rawRunState(raw) != int64(Failed)
+	}
+
+	snapshots, _ := raw["snapshots"].([]map[string]interface{})
+	for _, snap := range snapshots {
+		if _, ok := snap["provisioned"]; !ok {
+			snap["provisioned"] = rawRunState(snap) == int64(Running)
+		}
+	}
+
+	return nil
+}
+
+func startedSinceCreated(raw map[string]interface{}) bool {
+	started, ok := raw["started_at"].(time.Time)
+	if !ok || started.IsZero() {
+		return false
+	}
+
+	created, _ := raw["created_at"].(time.Time)
+	return !started.Before(created)
+}
+
+func rawRunState(raw map[string]interface{}) int64 {
+	state, _ := raw["run_state"].(int64)
+	return state
+}
+
+// roleFromName guesses a node's role from the lxdk-<cluster>-<role>-<id>
+// naming scheme.
+func roleFromName(name string) string {
+	for _, role := range []string{RoleController, RoleRegistry, RoleWorker, RoleEtcd} {
+		if strings.Contains(name, "-"+role+"-") {
+			return role
+		}
+	}
+
+	return ""
+}
+
+func rawStrings(v interface{}) []string {
+	var ret []string
+	switch v := v.(type) {
+	case []string:
+		ret = append(ret, v...)
+	case []interface{}:
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				ret = append(ret, s)
+			}
+		}
+	}
+
+	return ret
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+
+	return false
+}
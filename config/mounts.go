@@ -0,0 +1,105 @@
+package config
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Mount is a directory on the LXD host mounted into the workers of a
+// cluster, and into the controller if Controller is set.
+type Mount struct {
+	Source     string `toml:"source"`
+	Path       string `toml:"path"`
+	ReadOnly   bool   `toml:"read_only"`
+	Controller bool   `toml:"controller"`
+}
+
+// ParseMount parses a mount given as source:path[:options], where options
+// is a comma separated list of ro, for a read-only mount, and controller,
+// to mount into the controller as well as the workers.
+func ParseMount(spec string) (Mount, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Mount{}, errors.Errorf("invalid mount %s, must be source:path[:options]", spec)
+	}
+
+	m := Mount{Source: parts[0], Path: parts[1]}
+	if !path.IsAbs(m.Source) || !path.IsAbs(m.Path) {
+		return Mount{}, errors.Errorf("invalid mount %s, source and path must be absolute", spec)
+	}
+	m.Source = path.Clean(m.Source)
+	m.Path = path.Clean(m.Path)
+
+	if len(parts) == 3 {
+		for _, opt := range strings.Split(parts[2], ",") {
+			switch opt {
+			case "ro":
+				m.ReadOnly = true
+			case "rw":
+				m.ReadOnly = false
+			case "controller":
+				m.Controller = true
+			default:
+				return Mount{}, errors.Errorf("invalid mount %s, unknown option %s", spec, opt)
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// String formats m the way ParseMount reads it.
+func (m Mount) String() string {
+	var opts []string
+	if m.ReadOnly {
+		opts = append(opts, "ro")
+	}
+	if m.Controller {
+		opts = append(opts, "controller")
+	}
+
+	spec := m.Source + ":" + m.Path
+	if len(opts) > 0 {
+		spec += ":" + strings.Join(opts, ",")
+	}
+
+	return spec
+}
+
+// SetMount replaces the mount at the same path as m, or adds m.
+func (s *ClusterState) SetMount(m Mount) {
+	for i := range s.Mounts {
+		if s.Mounts[i].Path == m.Path {
+			s.Mounts[i] = m
+			return
+		}
+	}
+
+	s.Mounts = append(s.Mounts, m)
+}
+
+// RemoveMount forgets the mount at mountPath, returning false if there is
+// none.
+func (s *ClusterState) RemoveMount(mountPath string) (Mount, bool) {
+	mountPath = path.Clean(mountPath)
+	for i, m := range s.Mounts {
+		if m.Path == mountPath {
+			s.Mounts = append(s.Mounts[:i], s.Mounts[i+1:]...)
+			return m, true
+		}
+	}
+
+	return Mount{}, false
+}
+
+// MountNodes returns the containers m is mounted into.
+func (s ClusterState) MountNodes(m Mount) []string {
+	nodes := append([]string{}, s.WorkerContainerNames...)
+	if m.Controller && s.ControllerContainerName != "" {
+		nodes = append(nodes, s.ControllerContainerName)
+	}
+
+	return nodes
+}
@@ -0,0 +1,37 @@
+package config
+
+import "testing"
+
+func TestParseMount(t *testing.T) {
+	tests := []struct {
+		spec string
+		want Mount
+		err  bool
+	}{
+		{spec: "/home/me/src:/src", want: Mount{Source: "/home/me/src", Path: "/src"}},
+		{spec: "/data/:/data/:ro,controller", want: Mount{Source: "/data", Path: "/data", ReadOnly: true, Controller: true}},
+		{spec: "src:/src", err: true},
+		{spec: "/src", err: true},
+		{spec: "/src:/src:rx", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseMount(tt.spec)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseMount(%q) succeeded, want an error", tt.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseMount(%q): %s", tt.spec, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseMount(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+		if again, err := ParseMount(got.String()); err != nil || again != got {
+			t.Errorf("%q does not round trip through String: %+v, %v", tt.spec, again, err)
+		}
+	}
+}
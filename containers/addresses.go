@@ -0,0 +1,87 @@
+package containers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	lxdclient "github.com/lxc/lxd/client"
+)
+
+// NetworkAddresses returns the IPv4 subnet of the LXD network networkID and
+// the addresses in it already taken: the network's own address and every
+// lease LXD knows of. The subnet is nil if LXD can't give instances on the
+// network static addresses, because it isn't a managed bridge with IPv4.
+func NetworkAddresses(networkID string, is lxdclient.InstanceServer) (*net.IPNet, []net.IP, error) {
+	network, _, err := is.GetNetwork(networkID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not get network %s: %w", networkID, err)
+	}
+
+	if !network.Managed || network.Type != "bridge" {
+		return nil, nil, nil
+	}
+
+	gateway, subnet, err := net.ParseCIDR(network.Config["ipv4.address"])
+	if err != nil || gateway.To4() == nil {
+		// "none", or an address LXD hasn't picked yet
+		return nil, nil, nil
+	}
+
+	used := []net.IP{gateway}
+	leases, err := is.GetNetworkLeases(networkID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not get leases of network %s: %w", networkID, err)
+	}
+	for _, lease := range leases {
+		if ip := net.ParseIP(lease.Address); ip != nil {
+			used = append(used, ip)
+		}
+	}
+
+	return subnet, used, nil
+}
+
+// AllocateAddresses picks n free IPv4 addresses in subnet, skipping the
+// network and broadcast addresses and those in used. Addresses are taken
+// from the top of the subnet down, away from where DHCP servers usually
+// start handing out leases.
+func AllocateAddresses(subnet *net.IPNet, used []net.IP, n int) ([]net.IP, error) {
+	base := subnet.IP.To4()
+	if base == nil {
+		return nil, fmt.Errorf("%s is not an IPv4 subnet", subnet)
+	}
+
+	taken := make(map[string]bool)
+	for _, ip := range used {
+		taken[ip.String()] = true
+	}
+
+	ones, bits := subnet.Mask.Size()
+	first := binary.BigEndian.Uint32(base)
+	last := first | (1<<uint(bits-ones) - 1)
+
+	var addresses []net.IP
+	// the network and broadcast addresses are excluded
+	for i := last - 1; i > first && len(addresses) < n; i-- {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, i)
+		if taken[ip.String()] {
+			continue
+		}
+		addresses = append(addresses, ip)
+	}
+
+	if len(addresses) < n {
+		return nil, fmt.Errorf("subnet %s has %d free addresses, %d are needed", subnet, len(addresses), n)
+	}
+
+	return addresses, nil
+}
+
+// isAddressable returns true if device is a NIC LXD can give a static
+// address through its managed network's DHCP server.
+func isAddressable(device map[string]string) bool {
+	return device["network"] != "" || strings.EqualFold(device["nictype"], "bridged")
+}
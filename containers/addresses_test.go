@@ -0,0 +1,46 @@
+package containers
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAllocateAddresses(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.20.30.1/24")
+	used := []net.IP{
+		net.ParseIP("10.20.30.1"),
+		net.ParseIP("10.20.30.253"),
+	}
+
+	got, err := AllocateAddresses(subnet, used, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"10.20.30.254", "10.20.30.252", "10.20.30.251"}
+	var gotStrings []string
+	for _, ip := range got {
+		gotStrings = append(gotStrings, ip.String())
+	}
+	if !reflect.DeepEqual(gotStrings, want) {
+		t.Errorf("AllocateAddresses = %v, want %v", gotStrings, want)
+	}
+}
+
+func TestAllocateAddressesExhausted(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.1.0/30")
+
+	// a /30 has two host addresses, one of them the gateway
+	got, err := AllocateAddresses(subnet, []net.IP{net.ParseIP("192.168.1.1")}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0].String() != "192.168.1.2" {
+		t.Errorf("AllocateAddresses = %v, want 192.168.1.2", got)
+	}
+
+	if _, err := AllocateAddresses(subnet, []net.IP{net.ParseIP("192.168.1.1")}, 2); err == nil {
+		t.Error("allocating more addresses than the subnet has succeeded")
+	}
+}
@@ -0,0 +1,92 @@
+package containers
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	lxd "github.com/lxc/lxd/client"
+)
+
+// Cgroup hierarchies a cluster's nodes can run under. CgroupV1 nodes boot
+// systemd with the legacy hierarchy even on hybrid hosts; CgroupV2 nodes use
+// the unified hierarchy of a cgroup2-only host.
+const (
+	CgroupV1 = "v1"
+	CgroupV2 = "v2"
+)
+
+// ProfileName returns the name of the LXD profile for non-etcd nodes running
+// under cgroupMode, privileged unless unprivileged is set. Each combination
+// has its own profile, so clusters of every kind can share a host.
+func ProfileName(cgroupMode string, unprivileged bool) string {
+	name := "lxdk"
+	if cgroupMode == CgroupV2 {
+		name += "-cgroup2"
+	}
+	if unprivileged {
+		name += "-unprivileged"
+	}
+
+	return name
+}
+
+// DetectCgroupMode works out which cgroup hierarchy the LXD host uses. LXD
+// doesn't report the layout directly, so this requires liblxc's cgroup2
+// support from the server environment, reads the hierarchy of a local server
+// from /sys/fs/cgroup, and falls back on the defaults of the distribution a
+// remote server runs.
+func DetectCgroupMode(is lxd.InstanceServer, local bool) (string, error) {
+	server, _, err := is.GetServer()
+	if err != nil {
+		return "", fmt.Errorf("could not get lxd server environment: %w", err)
+	}
+
+	env := server.Environment
+	if env.LXCFeatures["cgroup2"] != "true" {
+		return CgroupV1, nil
+	}
+
+	if local {
+		// cgroup.controllers only exists at the root of a unified
+		// hierarchy
+		if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err == nil {
+			return CgroupV2, nil
+		}
+		return CgroupV1, nil
+	}
+
+	if unifiedByDefault(env.OSName, env.OSVersion) {
+		return CgroupV2, nil
+	}
+
+	return CgroupV1, nil
+}
+
+// unifiedByDefault returns true for distribution releases that boot with only
+// the cgroup2 hierarchy mounted.
+func unifiedByDefault(osName, osVersion string) bool {
+	since := map[string]float64{
+		"ubuntu": 21.10,
+		"fedora": 31,
+		"debian": 11,
+		"arch":   0,
+	}
+
+	osName = strings.ToLower(osName)
+	for distro, version := range since {
+		if !strings.Contains(osName, distro) {
+			continue
+		}
+
+		v, err := strconv.ParseFloat(osVersion, 64)
+		if err != nil {
+			// rolling releases don't have a numeric version
+			return version == 0
+		}
+		return v >= version
+	}
+
+	return false
+}
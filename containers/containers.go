@@ -2,7 +2,9 @@ package containers
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
@@ -10,17 +12,20 @@ import (
 	"os"
 	"path"
 	"strings"
-	"syscall"
 	"time"
 
+	"github.com/greymatter-io/lxdk/version"
 	lxd "github.com/lxc/lxd/client"
 	lxdclient "github.com/lxc/lxd/client"
 	"github.com/lxc/lxd/shared/api"
 )
 
-var (
-	UID int64
-	GID int64
+// Config keys set on every LXD resource lxdk creates, so that a cluster can
+// be found, and its state rebuilt, from LXD alone.
+const (
+	MetadataCluster = "user.lxdk.cluster"
+	MetadataRole    = "user.lxdk.role"
+	MetadataVersion = "user.lxdk.version"
 )
 
 type ContainerConfig struct {
@@ -28,26 +33,74 @@ type ContainerConfig struct {
 	ClusterName string
 	StoragePool string
 	NetworkID   string
+
+	// Profile is the profile applied to non-etcd nodes, "lxdk" if empty
+	Profile string
+
+	// Image is the fingerprint of the image to launch. If empty the
+	// unversioned alias for ImageName is used.
+	Image string
+
+	// IPv4 is the static address of the node on NetworkID. If empty the
+	// node gets an address by DHCP.
+	IPv4 string
 }
 
-func CreateContainerProfile(is lxdclient.InstanceServer) error {
+// Metadata returns the lxdk config keys for a resource of cluster. Networks
+// and storage pools are shared by every node and have no role.
+func Metadata(cluster, role string) map[string]string {
+	meta := map[string]string{
+		MetadataCluster: cluster,
+		MetadataVersion: version.Version(),
+	}
+	if role != "" {
+		meta[MetadataRole] = role
+	}
+
+	return meta
+}
+
+// CreateContainerProfile creates the profile for non-etcd nodes running under
+// cgroupMode, named as returned by ProfileName.
+func CreateContainerProfile(cgroupMode string, unprivileged bool, is lxdclient.InstanceServer) error {
 	prof, _, err := is.GetProfile("default")
 	if err != nil {
 		return fmt.Errorf("could not get lxd default profile: %w", err)
 	}
 
 	newProf := api.ProfilesPost{
-		Name: "lxdk",
+		Name: ProfileName(cgroupMode, unprivileged),
 	}
 	newProf.Devices = prof.Devices
-	newProf.Config = map[string]string{
-		"raw.lxc": `lxc.apparmor.profile=unconfined
+
+	if unprivileged {
+		newProf.Config = unprivilegedProfileConfig(cgroupMode)
+		if err := is.CreateProfile(newProf); err != nil {
+			return fmt.Errorf("could not create profile: %w", err)
+		}
+
+		return nil
+	}
+
+	// the v1 profile makes systemd mount the legacy hierarchy, the
+	// unified profile is kubedee's profile for cgroup2 hosts
+	rawLXC := `lxc.apparmor.profile=unconfined
 lxc.mount.auto=proc:rw sys:rw cgroup:rw
 lxc.init.cmd=/sbin/init systemd.unified_cgroup_hierarchy=0
 lxc.cgroup.devices.allow=a
 lxc.cgroup2.devices.allow=a
 lxc.cap.drop=
-lxc.apparmor.allow_incomplete=1`,
+lxc.apparmor.allow_incomplete=1`
+	if cgroupMode == CgroupV2 {
+		rawLXC = `lxc.apparmor.profile=unconfined
+lxc.mount.auto=proc:rw sys:rw cgroup:rw:force
+lxc.cgroup2.devices.allow=a
+lxc.cap.drop=
+lxc.apparmor.allow_incomplete=1`
+	}
+
+	newProf.Config = map[string]string{
+		"raw.lxc":              rawLXC,
 		"security.privileged":  "true",
 		"security.nesting":     "true",
 		"linux.kernel_modules": "ip_tables,ip6_tables,netlink_diag,nf_nat,overlay",
@@ -61,27 +114,62 @@ lxc.apparmor.allow_incomplete=1`,
 	return nil
 }
 
-func CreateContainer(config ContainerConfig, is lxdclient.InstanceServer) (string, error) {
-	// TODO: https://github.com/zer0def/kubedee/blob/master/lib.bash#L1116
-	// kubdee applies unified_profile if cgroup=2
+// unprivilegedProfileConfig returns the config of the profile for
+// unprivileged nodes running under cgroupMode. The nodes keep LXD's AppArmor
+// profile and capabilities; what the kubelet and CRI-O need from the host is
+// granted through syscall interception, and the kernel modules they'd load
+// themselves are loaded by LXD when a node starts.
+func unprivilegedProfileConfig(cgroupMode string) map[string]string {
+	rawLXC := `lxc.mount.auto=proc:rw sys:rw cgroup:rw
+lxc.init.cmd=/sbin/init systemd.unified_cgroup_hierarchy=0`
+	if cgroupMode == CgroupV2 {
+		rawLXC = `lxc.mount.auto=proc:rw sys:rw cgroup:rw:force`
+	}
+
+	conf := map[string]string{
+		"raw.lxc":                              rawLXC,
+		"security.nesting":                     "true",
+		"security.idmap.isolated":              "true",
+		"security.syscalls.intercept.mknod":    "true",
+		"security.syscalls.intercept.setxattr": "true",
+		"linux.kernel_modules":                 "ip_tables,ip6_tables,netlink_diag,nf_nat,overlay,br_netfilter,nf_conntrack,xt_conntrack,iptable_nat,iptable_filter",
+	}
+	// runc manages device access with eBPF programs under cgroup2, which
+	// only LXD can load on its behalf
+	if cgroupMode == CgroupV2 {
+		conf["security.syscalls.intercept.bpf"] = "true"
+		conf["security.syscalls.intercept.bpf.devices"] = "true"
+	}
+
+	return conf
+}
+
+// CreateContainer creates a stopped node for the cluster in config and
+// returns its name, giving up when ctx is done.
+func CreateContainer(ctx context.Context, config ContainerConfig, is lxdclient.InstanceServer) (string, error) {
+	if config.Profile == "" {
+		config.Profile = ProfileName(CgroupV1, false)
+	}
 
 	conf := api.InstancesPost{
 		Name: fmt.Sprintf("lxdk-%s-%s-%s", config.ClusterName, config.ImageName, createID()),
 		Source: api.InstanceSource{
 			Type:  "image",
-			Alias: "kubedee-" + config.ImageName,
+			Alias: ImageAlias(config.ImageName),
 		},
 		Type: "container",
 	}
 
-	if !strings.Contains(conf.Name, "etcd") {
-		conf.Profiles = []string{"lxdk"}
-	} else {
-		conf.Config = map[string]string{"raw.lxc": "lxc.apparmor.allow_incomplete=1"}
+	if config.Image != "" {
+		conf.Source.Alias = ""
+		conf.Source.Fingerprint = config.Image
 	}
 
-	if config.ImageName == "registry" {
-		conf.Source.Alias = "kubedee-worker"
+	conf.Config = Metadata(config.ClusterName, config.ImageName)
+	if !strings.Contains(conf.Name, "etcd") {
+		conf.Profiles = []string{config.Profile}
+	} else {
+		conf.Config["raw.lxc"] = "lxc.apparmor.allow_incomplete=1"
 	}
 
 	conf.Devices = map[string]map[string]string{
@@ -93,11 +181,33 @@ func CreateContainer(config ContainerConfig, is lxdclient.InstanceServer) (strin
 	}
 
 	// add network to container
-	net, _, err := is.GetNetwork(config.NetworkID)
+	device, err := nicDevice(config.NetworkID, config.IPv4, is)
+	if err != nil {
+		return "", err
+	}
+	conf.Devices["eth0"] = device
+
+	op, err := is.CreateInstance(conf)
+	if err != nil {
+		return "", fmt.Errorf("there was an error creating the instance: (%w), does the image '%s' exist?", err, conf.Source.Alias+conf.Source.Fingerprint)
+	}
+
+	err = waitOperation(ctx, op)
 	if err != nil {
 		return "", err
 	}
 
+	return conf.Name, nil
+}
+
+// nicDevice returns the eth0 device that attaches a container to networkID,
+// with the static address ipv4 unless it is empty.
+func nicDevice(networkID, ipv4 string, is lxdclient.InstanceServer) (map[string]string, error) {
+	net, _, err := is.GetNetwork(networkID)
+	if err != nil {
+		return nil, err
+	}
+
 	var device map[string]string
 	if net.Managed && is.HasExtension("instance_nic_network") {
 		device = map[string]string{
@@ -117,22 +227,216 @@ func CreateContainer(config ContainerConfig, is lxdclient.InstanceServer) (strin
 	}
 	device["name"] = "eth0"
 
-	conf.Devices["eth0"] = device
+	if ipv4 != "" {
+		if !isAddressable(device) {
+			return nil, fmt.Errorf("network %s can't give nodes static addresses", networkID)
+		}
+		device["ipv4.address"] = ipv4
+	}
 
-	op, err := is.CreateInstance(conf)
+	return device, nil
+}
+
+// CloneContainer copies the container source, or its snapshot named
+// snapshot if that is not empty, into a new stopped container belonging to
+// the cluster in config, on its storage pool and network. The copy gets a new
+// name and MAC address. The name of the copy is returned.
+func CloneContainer(source, snapshot string, config ContainerConfig, is lxdclient.InstanceServer) (string, error) {
+	name := fmt.Sprintf("lxdk-%s-%s-%s", config.ClusterName, config.ImageName, createID())
+
+	nic, err := nicDevice(config.NetworkID, config.IPv4, is)
 	if err != nil {
-		return "", fmt.Errorf("there was an error creating the instance: (%w), does the image '%s' exist?", err, "kuedee-"+config.ImageName)
+		return "", err
 	}
 
-	err = op.Wait()
+	var op lxdclient.RemoteOperation
+	if snapshot == "" {
+		in, _, err := is.GetInstance(source)
+		if err != nil {
+			return "", err
+		}
+		retargetInstance(&in.Config, &in.Devices, config, nic, true)
+
+		op, err = is.CopyInstance(is, *in, &lxdclient.InstanceCopyArgs{
+			Name:         name,
+			InstanceOnly: true,
+		})
+		if err != nil {
+			return "", fmt.Errorf("could not copy %s: %w", source, err)
+		}
+	} else {
+		snap, _, err := is.GetInstanceSnapshot(source, snapshot)
+		if err != nil {
+			return "", fmt.Errorf("could not get snapshot %s of %s: %w", snapshot, source, err)
+		}
+		retargetInstance(&snap.Config, &snap.Devices, config, nic, true)
+
+		op, err = is.CopyInstanceSnapshot(is, source, *snap, &lxdclient.InstanceSnapshotCopyArgs{
+			Name: name,
+		})
+		if err != nil {
+			return "", fmt.Errorf("could not copy snapshot %s of %s: %w", snapshot, source, err)
+		}
+	}
+
+	if err := op.Wait(); err != nil {
+		return "", fmt.Errorf("could not copy %s: %w", source, err)
+	}
+
+	return name, nil
+}
+
+// ImportContainer creates a stopped container from an LXD instance backup of
+// the container name and moves it into the cluster in config, onto its
+// storage pool and network. If rename is set the container gets a new name
+// and MAC address. Host directories mounted into the container are removed,
+// as they may not exist on this host. The name of the container is returned.
+func ImportContainer(backup io.Reader, name string, rename bool, config ContainerConfig, is lxdclient.InstanceServer) (string, error) {
+	if rename {
+		name = fmt.Sprintf("lxdk-%s-%s-%s", config.ClusterName, config.ImageName, createID())
+	}
+
+	nic, err := nicDevice(config.NetworkID, config.IPv4, is)
 	if err != nil {
 		return "", err
 	}
 
-	return conf.Name, nil
+	op, err := is.CreateInstanceFromBackup(lxdclient.InstanceBackupArgs{
+		BackupFile: backup,
+		PoolName:   config.StoragePool,
+		Name:       name,
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not import %s: %w", name, err)
+	}
+	if err := op.Wait(); err != nil {
+		return "", fmt.Errorf("could not import %s: %w", name, err)
+	}
+
+	in, etag, err := is.GetInstance(name)
+	if err != nil {
+		return "", err
+	}
+	retargetInstance(&in.Config, &in.Devices, config, nic, rename)
+	removeMountDevices(in.Devices)
+
+	op, err = is.UpdateInstance(name, in.Writable(), etag)
+	if err != nil {
+		return "", fmt.Errorf("could not update %s: %w", name, err)
+	}
+	if err := op.Wait(); err != nil {
+		return "", fmt.Errorf("could not update %s: %w", name, err)
+	}
+
+	return name, nil
+}
+
+// ExportContainer writes an LXD backup of container, without its snapshots,
+// to w.
+func ExportContainer(container string, w io.WriteSeeker, is lxdclient.InstanceServer) error {
+	backupName := "lxdk-export-" + createID()
+	req := api.InstanceBackupsPost{
+		Name:         backupName,
+		ExpiresAt:    time.Now().Add(24 * time.Hour),
+		InstanceOnly: true,
+	}
+	// the archive the backups go into is compressed as a whole
+	if is.HasExtension("backup_compression_algorithm") {
+		req.CompressionAlgorithm = "none"
+	}
+
+	op, err := is.CreateInstanceBackup(container, req)
+	if err != nil {
+		return fmt.Errorf("could not back up %s: %w", container, err)
+	}
+	if err := op.Wait(); err != nil {
+		return fmt.Errorf("could not back up %s: %w", container, err)
+	}
+	defer func() {
+		op, err := is.DeleteInstanceBackup(container, backupName)
+		if err == nil {
+			err = op.Wait()
+		}
+		if err != nil {
+			log.Printf("could not delete backup %s of %s: %s", backupName, container, err)
+		}
+	}()
+
+	_, err = is.GetInstanceBackupFile(container, backupName, &lxdclient.BackupFileRequest{
+		BackupFile: w,
+	})
+	if err != nil {
+		return fmt.Errorf("could not download backup of %s: %w", container, err)
+	}
+
+	return nil
 }
 
-func StartContainer(containerName string, is lxd.InstanceServer) error {
+// ImageAlias returns the alias of the LXD image a node with the given image
+// name is launched from.
+func ImageAlias(imageName string) string {
+	if imageName == "registry" {
+		return "kubedee-worker"
+	}
+
+	return "kubedee-" + imageName
+}
+
+// VersionedImageAlias returns the alias of the image for imageName built for
+// kubernetesVersion, e.g. lxdk-worker-v1.23.1, or the unversioned alias if
+// kubernetesVersion is empty.
+func VersionedImageAlias(imageName, kubernetesVersion string) string {
+	if kubernetesVersion == "" {
+		return ImageAlias(imageName)
+	}
+
+	if imageName == "registry" {
+		imageName = "worker"
+	}
+
+	return fmt.Sprintf("lxdk-%s-%s", imageName, kubernetesVersion)
+}
+
+// ResolveImage returns the full fingerprint of the image ref refers to. ref
+// may be an alias, a fingerprint, or a unique prefix of a fingerprint.
+func ResolveImage(ref string, is lxd.InstanceServer) (string, error) {
+	alias, _, err := is.GetImageAlias(ref)
+	if err == nil {
+		return alias.Target, nil
+	}
+
+	image, _, err := is.GetImage(ref)
+	if err == nil {
+		return image.Fingerprint, nil
+	}
+
+	return "", fmt.Errorf("no image with alias or fingerprint %s", ref)
+}
+
+// GetContainerImage returns the fingerprint of the image a container was
+// launched from.
+func GetContainerImage(name string, is lxd.InstanceServer) (string, error) {
+	in, _, err := is.GetInstance(name)
+	if err != nil {
+		return "", fmt.Errorf("error getting instance: %w", err)
+	}
+
+	return in.Config["volatile.base_image"], nil
+}
+
+// GetContainerMAC returns the MAC address LXD assigned to the eth0 device of
+// the container.
+func GetContainerMAC(name string, is lxd.InstanceServer) (string, error) {
+	in, _, err := is.GetInstance(name)
+	if err != nil {
+		return "", fmt.Errorf("error getting instance: %w", err)
+	}
+
+	return in.Config["volatile.eth0.hwaddr"], nil
+}
+
+// StartContainer starts containerName, giving up when ctx is done.
+func StartContainer(ctx context.Context, containerName string, is lxd.InstanceServer) error {
 	reqState := api.InstanceStatePut{
 		Action:  "start",
 		Timeout: -1,
@@ -143,7 +447,7 @@ func StartContainer(containerName string, is lxd.InstanceServer) error {
 		return err
 	}
 
-	err = op.Wait()
+	err = waitOperation(ctx, op)
 	if err != nil {
 		return err
 	}
@@ -151,6 +455,25 @@ func StartContainer(containerName string, is lxd.InstanceServer) error {
 	return nil
 }
 
+// waitOperation waits for op to finish. If ctx is done first op is
+// cancelled, if LXD allows it, and ctx's error is returned.
+func waitOperation(ctx context.Context, op lxdclient.Operation) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- op.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if err := op.Cancel(); err != nil {
+			log.Default().Printf("could not cancel operation %s: %s", op.Get().ID, err)
+		}
+		return fmt.Errorf("operation %s was abandoned: %w", op.Get().Description, ctx.Err())
+	}
+}
+
 func StopContainer(containerName string, is lxd.InstanceServer) error {
 	reqState := api.InstanceStatePut{
 		Action:  "stop",
@@ -185,18 +508,20 @@ func DeleteContainer(containerName string, is lxd.InstanceServer) error {
 	return nil
 }
 
-func WaitContainerIP(name string, blacklist []string, is lxd.InstanceServer) (net.IP, error) {
-	var ip net.IP
-	var err error
-	ip, err = GetContainerLXDIP(name, blacklist, is)
-	for c := 0; c < 50 && err != nil; c++ {
+// WaitContainerIP polls until container name has an address that isn't in
+// blacklist, giving up when ctx is done.
+func WaitContainerIP(ctx context.Context, name string, blacklist []string, is lxd.InstanceServer) (net.IP, error) {
+	ip, err := GetContainerLXDIP(name, blacklist, is)
+	for err != nil {
 		log.Default().Printf("waiting for %s to get an IP address...", name)
-		time.Sleep(2 * time.Second)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%s did not get an IP address: %w", name, ctx.Err())
+		case <-time.After(2 * time.Second):
+		}
 		ip, err = GetContainerLXDIP(name, blacklist, is)
 	}
-	if err != nil {
-		return nil, err
-	}
+
 	return ip, nil
 }
 
@@ -246,59 +571,72 @@ func GetContainerLXDIP(name string, blacklist []string, is lxd.InstanceServer) (
 	return ip, nil
 }
 
-// from is a file, to is a dir
+// FileOptions sets the mode and owner of a file pushed to a container. A
+// zero Mode means DefaultFileMode of the file's name. Files are owned by
+// root unless UID or GID are set.
+type FileOptions struct {
+	Mode os.FileMode
+	UID  int64
+	GID  int64
+}
+
+// DefaultFileMode returns the mode a file pushed to a container gets unless
+// told otherwise: 0600 for private keys and kubeconfigs, which embed client
+// keys, and 0644 for everything else.
+func DefaultFileMode(name string) os.FileMode {
+	name = path.Base(name)
+	if strings.HasSuffix(name, "-key.pem") || strings.HasSuffix(name, ".key") || strings.HasSuffix(name, ".kubeconfig") {
+		return 0600
+	}
+
+	return 0644
+}
+
+// UploadFile pushes a file to container with FileOptions' defaults. If data
+// is empty, the local file from is pushed into the directory to; otherwise
+// data is written to the file to.
 func UploadFile(data []byte, from, to, container string, is lxdclient.InstanceServer) error {
-	var mode os.FileMode
+	return UploadFileWithOptions(data, from, to, container, FileOptions{}, is)
+}
+
+// UploadFileWithOptions is UploadFile with an explicit mode and owner.
+func UploadFileWithOptions(data []byte, from, to, container string, opts FileOptions, is lxdclient.InstanceServer) error {
 	var toPath string
 	// if data does not exist, read a file from disk and to should be a
 	// directory
-	if data == nil || len(data) == 0 {
-		stat, err := os.Stat(from)
-		if err != nil {
-			return fmt.Errorf("cannot stat %s: %w", from, err)
-		}
-
-		if linuxstat, ok := stat.Sys().(*syscall.Stat_t); ok {
-			UID = int64(linuxstat.Uid)
-			GID = int64(linuxstat.Gid)
-		}
-		mode = os.FileMode(0755)
-
+	if len(data) == 0 {
+		var err error
 		data, err = ioutil.ReadFile(from)
 		if err != nil {
 			return fmt.Errorf("cannot read %s: %w", from, err)
 		}
 		_, filename := path.Split(from)
 		toPath = path.Join(to, filename)
-
-		err = RecursiveMkdir(container, to, mode, UID, GID, is)
-		if err != nil {
-			return err
-		}
 	} else {
-		// if data exists, to should be a filename and we have to
-		// let lxc infer the UID and GID
 		toPath = to
-		mode = os.FileMode(0755)
+	}
 
-		toDir, _ := path.Split(to)
-		err := RecursiveMkdir(container, toDir, mode, UID, GID, is)
-		if err != nil {
-			return err
-		}
+	mode := opts.Mode
+	if mode == 0 {
+		mode = DefaultFileMode(toPath)
 	}
 
-	reader := bytes.NewReader(data)
+	toDir, _ := path.Split(toPath)
+	err := RecursiveMkdir(container, toDir, 0755, opts.UID, opts.GID, is)
+	if err != nil {
+		return err
+	}
 
 	args := lxdclient.InstanceFileArgs{
-		Type:    "file",
-		UID:     UID,
-		GID:     GID,
-		Mode:    int(mode.Perm()),
-		Content: reader,
+		Type:      "file",
+		UID:       opts.UID,
+		GID:       opts.GID,
+		Mode:      int(mode.Perm()),
+		Content:   bytes.NewReader(data),
+		WriteMode: "overwrite",
 	}
 
-	err := is.CreateInstanceFile(container, toPath, args)
+	err = is.CreateInstanceFile(container, toPath, args)
 	if err != nil {
 		return fmt.Errorf("cannot push %s to %s: %w", from, toPath, err)
 	}
@@ -306,6 +644,23 @@ func UploadFile(data []byte, from, to, container string, is lxdclient.InstanceSe
 	return nil
 }
 
+// DownloadFile returns the contents of the file at path in container.
+func DownloadFile(container, path string, is lxdclient.InstanceServer) ([]byte, error) {
+	content, resp, err := is.GetInstanceFile(container, path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot pull %s from %s: %w", path, container, err)
+	}
+	if resp.Type != "file" {
+		if content != nil {
+			content.Close()
+		}
+		return nil, fmt.Errorf("%s in %s is not a file", path, container)
+	}
+	defer content.Close()
+
+	return ioutil.ReadAll(content)
+}
+
 func RecursiveMkdir(container, dir string, mode os.FileMode, UID, GID int64, is lxdclient.InstanceServer) error {
 	if dir == "/" {
 		return nil
@@ -334,7 +689,7 @@ func RecursiveMkdir(container, dir string, mode os.FileMode, UID, GID int64, is
 	args := lxdclient.InstanceFileArgs{
 		Type: "directory",
 		UID:  UID,
-		GID:  UID,
+		GID:  GID,
 		Mode: int(mode.Perm()),
 	}
 	return is.CreateInstanceFile(container, dir, args)
@@ -350,27 +705,20 @@ func UploadFiles(froms []string, to, container string, is lxdclient.InstanceServ
 	return nil
 }
 
-func RunCommand(container, command string, is lxdclient.InstanceServer) error {
-	split := strings.Fields(command)
-
-	op, err := is.ExecInstance(container, api.InstanceExecPost{
-		Command: split,
-	}, &lxdclient.InstanceExecArgs{})
-	if err != nil {
-		return err
-	}
-
-	err = op.Wait()
-	if err != nil {
-		return fmt.Errorf("could not run command %s: %w", command, err)
-	}
-
-	return nil
+// RunCommand runs command in container through sh, so it is split and
+// quoted as it would be in a terminal. It fails with the command's output if
+// the command exits with a non-zero status, and kills the command if ctx is
+// done first.
+func RunCommand(ctx context.Context, container, command string, is lxdclient.InstanceServer) error {
+	_, err := ExecContext(ctx, container, ExecOptions{Command: ShellCommand(command)}, is)
+	return err
 }
 
-func RunCommands(container string, commands []string, is lxdclient.InstanceServer) error {
+// RunCommands runs commands in container one after the other with
+// RunCommand, stopping at the first that fails.
+func RunCommands(ctx context.Context, container string, commands []string, is lxdclient.InstanceServer) error {
 	for _, command := range commands {
-		err := RunCommand(container, command, is)
+		err := RunCommand(ctx, container, command, is)
 		if err != nil {
 			return err
 		}
@@ -379,6 +727,44 @@ func RunCommands(container string, commands []string, is lxdclient.InstanceServe
 	return nil
 }
 
+// retargetInstance moves the config and devices of an instance being copied
+// or imported into the cluster in config. If newIdentity is set, volatile
+// keys that hold the identity of the source, such as its MAC address, are
+// dropped for LXD to regenerate, along with proxy devices.
+func retargetInstance(conf *map[string]string, devices *map[string]map[string]string, config ContainerConfig, nic map[string]string, newIdentity bool) {
+	if *conf == nil {
+		*conf = make(map[string]string)
+	}
+	if *devices == nil {
+		*devices = make(map[string]map[string]string)
+	}
+
+	if newIdentity {
+		for key := range *conf {
+			if strings.HasPrefix(key, "volatile.") && key != "volatile.base_image" {
+				delete(*conf, key)
+			}
+		}
+		// the host ports proxies listen on can't be shared with the
+		// original
+		for name, device := range *devices {
+			if device["type"] == "proxy" {
+				delete(*devices, name)
+			}
+		}
+	}
+	for key, value := range Metadata(config.ClusterName, config.ImageName) {
+		(*conf)[key] = value
+	}
+
+	(*devices)["root"] = map[string]string{
+		"type": "disk",
+		"pool": config.StoragePool,
+		"path": "/",
+	}
+	(*devices)["eth0"] = nic
+}
+
 func createID() string {
 	validChars := []rune("abcdefghijklmnopqrstuvwxyz0123456789")
 
@@ -0,0 +1,56 @@
+package containers
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDefaultFileMode(t *testing.T) {
+	tests := map[string]os.FileMode{
+		"/etc/kubernetes/ca-key.pem":                0600,
+		"/etc/etcd/etcd-key.pem":                    0600,
+		"/etc/kubernetes/kube-scheduler.kubeconfig": 0600,
+		"/etc/kubernetes/ca.pem":                    0644,
+		"/etc/kubernetes/config/kubelet.yaml":       0644,
+		"/etc/systemd/system/kubelet.service":       0644,
+		"/etc/crio/crio.conf.d/10-lxdk-cgroup.conf": 0644,
+	}
+
+	for name, want := range tests {
+		if got := DefaultFileMode(name); got != want {
+			t.Errorf("DefaultFileMode(%q) = %o, want %o", name, got, want)
+		}
+	}
+}
+
+func TestMountDeviceName(t *testing.T) {
+	tests := map[string]string{
+		"/src":          "lxdk-mount-src",
+		"/home/me/src/": "lxdk-mount-home-me-src",
+		"/":             "lxdk-mount-root",
+	}
+
+	for path, want := range tests {
+		if got := MountDeviceName(path); got != want {
+			t.Errorf("MountDeviceName(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestRemoveMountDevices(t *testing.T) {
+	devices := map[string]map[string]string{
+		"root":                  {"type": "disk", "path": "/"},
+		"eth0":                  {"type": "nic"},
+		"tun":                   {"type": "unix-char"},
+		MountDeviceName("/src"): {"type": "disk", "source": "/home/me/src", "path": "/src"},
+	}
+
+	removeMountDevices(devices)
+
+	if _, ok := devices[MountDeviceName("/src")]; ok {
+		t.Error("mount device was not removed")
+	}
+	if len(devices) != 3 {
+		t.Errorf("expected the other 3 devices to be kept, got %v", devices)
+	}
+}
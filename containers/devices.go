@@ -0,0 +1,55 @@
+package containers
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	lxdclient "github.com/lxc/lxd/client"
+)
+
+// hostDevicePrefix prefixes the names of the devices SetHostDevices
+// manages, so they can be told apart from devices added any other way.
+const hostDevicePrefix = "lxdk-dev-"
+
+// legacyHostDevice matches the names devices passed through to workers had
+// before they were configurable.
+var legacyHostDevice = regexp.MustCompile(`^(loop[0-9]|net-tun)$`)
+
+// SetHostDevices makes devices, keyed by name, the host devices passed
+// through to container, removing any passed through before that aren't in
+// devices. Container isn't updated if it already has exactly devices.
+func SetHostDevices(container string, devices map[string]map[string]string, is lxdclient.InstanceServer) error {
+	in, etag, err := is.GetInstance(container)
+	if err != nil {
+		return fmt.Errorf("could not get %s: %w", container, err)
+	}
+
+	if in.Devices == nil {
+		in.Devices = make(map[string]map[string]string)
+	}
+	before := copyDevices(in.Devices)
+	for name := range in.Devices {
+		if strings.HasPrefix(name, hostDevicePrefix) || legacyHostDevice.MatchString(name) {
+			delete(in.Devices, name)
+		}
+	}
+	for name, device := range devices {
+		in.Devices[hostDevicePrefix+name] = device
+	}
+	if reflect.DeepEqual(before, in.Devices) {
+		return nil
+	}
+
+	return updateInstance(container, in.Writable(), etag, is)
+}
+
+func copyDevices(devices map[string]map[string]string) map[string]map[string]string {
+	copied := make(map[string]map[string]string, len(devices))
+	for name, device := range devices {
+		copied[name] = device
+	}
+
+	return copied
+}
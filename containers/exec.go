@@ -0,0 +1,313 @@
+package containers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	lxdclient "github.com/lxc/lxd/client"
+	"github.com/lxc/lxd/shared/api"
+	"github.com/lxc/lxd/shared/termios"
+)
+
+// ExecOptions configures a command run in a container by Exec.
+type ExecOptions struct {
+	// Command is the argv of the command. It is not run through a shell,
+	// use ShellCommand for that.
+	Command []string
+
+	// Env is added to the environment of the command
+	Env map[string]string
+
+	// Timeout, if non-zero, kills the command once it has run this long
+	Timeout time.Duration
+
+	Stdin io.Reader
+
+	// Stdout and Stderr, if set, receive the output of the command as it
+	// is produced instead of it being captured in the ExecResult
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// ExecResult is the outcome of a command run by Exec.
+type ExecResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// ExecError is returned by Exec when a command exits with a non-zero status
+// or is killed by its timeout.
+type ExecError struct {
+	Container string
+	Command   []string
+	Result    ExecResult
+	TimedOut  bool
+}
+
+func (e *ExecError) Error() string {
+	command := strings.Join(e.Command, " ")
+	if e.TimedOut {
+		return fmt.Sprintf("command %q in %s timed out", command, e.Container)
+	}
+
+	output := strings.TrimSpace(e.Result.Stderr)
+	if output == "" {
+		output = strings.TrimSpace(e.Result.Stdout)
+	}
+	if output == "" {
+		return fmt.Sprintf("command %q in %s exited with status %d", command, e.Container, e.Result.ExitCode)
+	}
+
+	return fmt.Sprintf("command %q in %s exited with status %d: %s", command, e.Container, e.Result.ExitCode, output)
+}
+
+// ShellCommand returns the argv that runs command with sh, so pipes,
+// redirects and quoting in command work as they would in a terminal.
+func ShellCommand(command string) []string {
+	return []string{"sh", "-c", command}
+}
+
+// ShellQuote quotes each of args so that a shell splits the result back into
+// exactly args.
+func ShellQuote(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+// ExecContext runs a command in container and returns its output and exit
+// status, killing the command if ctx is done before it exits. A non-zero
+// exit status is returned as an *ExecError along with the result.
+func ExecContext(ctx context.Context, container string, opts ExecOptions, is lxdclient.InstanceServer) (ExecResult, error) {
+	var result ExecResult
+	var stdout, stderr bytes.Buffer
+
+	var outW, errW io.Writer = &stdout, &stderr
+	if opts.Stdout != nil {
+		outW = opts.Stdout
+	}
+	if opts.Stderr != nil {
+		errW = opts.Stderr
+	}
+
+	stdin := ioutil.NopCloser(bytes.NewReader(nil))
+	if opts.Stdin != nil {
+		stdin = ioutil.NopCloser(opts.Stdin)
+	}
+
+	// the control websocket is used to kill the command on timeout or
+	// cancellation
+	var controlMu sync.Mutex
+	var control *websocket.Conn
+	controlDone := make(chan struct{})
+	dataDone := make(chan bool)
+	args := &lxdclient.InstanceExecArgs{
+		Stdin:  stdin,
+		Stdout: nopWriteCloser{outW},
+		Stderr: nopWriteCloser{errW},
+		Control: func(conn *websocket.Conn) {
+			controlMu.Lock()
+			control = conn
+			controlMu.Unlock()
+			<-controlDone
+		},
+		DataDone: dataDone,
+	}
+	defer close(controlDone)
+
+	op, err := is.ExecInstance(container, api.InstanceExecPost{
+		Command:     opts.Command,
+		Environment: opts.Env,
+		WaitForWS:   true,
+	}, args)
+	if err != nil {
+		return result, fmt.Errorf("could not run command %s in %s: %w", strings.Join(opts.Command, " "), container, err)
+	}
+
+	waitErr := make(chan error, 1)
+	go func() {
+		waitErr <- op.Wait()
+	}()
+
+	var timeout <-chan time.Time
+	if opts.Timeout > 0 {
+		timer := time.NewTimer(opts.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	// kill stops the command. Until the control websocket is connected the
+	// command can't be signalled, so the operation is cancelled instead. If
+	// neither works the command is left running and false is returned.
+	kill := func() bool {
+		controlMu.Lock()
+		defer controlMu.Unlock()
+		if control != nil {
+			return control.WriteJSON(api.InstanceExecControl{
+				Command: "signal",
+				Signal:  int(syscall.SIGKILL),
+			}) == nil
+		}
+
+		return op.Cancel() == nil
+	}
+
+	timedOut, cancelled := false, false
+	select {
+	case err = <-waitErr:
+	case <-timeout:
+		timedOut = true
+	case <-ctx.Done():
+		cancelled = true
+	}
+	if timedOut || cancelled {
+		if !kill() {
+			// the command may still be writing its output, so none of
+			// it is returned
+			if cancelled {
+				return result, fmt.Errorf("command %s in %s: %w", strings.Join(opts.Command, " "), container, ctx.Err())
+			}
+			return result, &ExecError{
+				Container: container,
+				Command:   opts.Command,
+				TimedOut:  true,
+			}
+		}
+		err = <-waitErr
+	}
+
+	if cancelled {
+		<-dataDone
+		return result, fmt.Errorf("command %s in %s: %w", strings.Join(opts.Command, " "), container, ctx.Err())
+	}
+	if err != nil && !timedOut {
+		return result, fmt.Errorf("could not run command %s in %s: %w", strings.Join(opts.Command, " "), container, err)
+	}
+
+	// wait for the output to be flushed
+	<-dataDone
+
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+	if code, ok := op.Get().Metadata["return"].(float64); ok {
+		result.ExitCode = int(code)
+	}
+
+	if timedOut || result.ExitCode != 0 {
+		return result, &ExecError{
+			Container: container,
+			Command:   opts.Command,
+			Result:    result,
+			TimedOut:  timedOut,
+		}
+	}
+
+	return result, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// ExecInteractive runs command in container attached to the current terminal,
+// with a TTY sized to it, and returns the command's exit status.
+func ExecInteractive(container string, command []string, is lxdclient.InstanceServer) (int, error) {
+	stdinFd := int(os.Stdin.Fd())
+	if !termios.IsTerminal(stdinFd) {
+		return -1, fmt.Errorf("stdin is not a terminal")
+	}
+
+	width, height, err := termios.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		return -1, fmt.Errorf("could not get terminal size: %w", err)
+	}
+
+	oldState, err := termios.MakeRaw(stdinFd)
+	if err != nil {
+		return -1, fmt.Errorf("could not make terminal raw: %w", err)
+	}
+	defer termios.Restore(stdinFd, oldState)
+
+	env := map[string]string{"TERM": os.Getenv("TERM")}
+	if env["TERM"] == "" {
+		env["TERM"] = "xterm"
+	}
+
+	done := make(chan struct{})
+	dataDone := make(chan bool)
+	args := &lxdclient.InstanceExecArgs{
+		Stdin:  ioutil.NopCloser(os.Stdin),
+		Stdout: nopWriteCloser{os.Stdout},
+		Stderr: nopWriteCloser{os.Stderr},
+		Control: func(conn *websocket.Conn) {
+			resizeOnWinch(conn, done)
+		},
+		DataDone: dataDone,
+	}
+	defer close(done)
+
+	op, err := is.ExecInstance(container, api.InstanceExecPost{
+		Command:     command,
+		Environment: env,
+		WaitForWS:   true,
+		Interactive: true,
+		Width:       width,
+		Height:      height,
+	}, args)
+	if err != nil {
+		return -1, fmt.Errorf("could not run %s in %s: %w", strings.Join(command, " "), container, err)
+	}
+
+	if err := op.Wait(); err != nil {
+		return -1, err
+	}
+	<-dataDone
+
+	code, _ := op.Get().Metadata["return"].(float64)
+	return int(code), nil
+}
+
+// resizeOnWinch forwards terminal size changes to an interactive command
+// until done is closed.
+func resizeOnWinch(conn *websocket.Conn, done <-chan struct{}) {
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-winch:
+			width, height, err := termios.GetSize(int(os.Stdout.Fd()))
+			if err != nil {
+				continue
+			}
+
+			conn.WriteJSON(api.InstanceExecControl{
+				Command: "window-resize",
+				Args: map[string]string{
+					"width":  strconv.Itoa(width),
+					"height": strconv.Itoa(height),
+				},
+			})
+		}
+	}
+}
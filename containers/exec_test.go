@@ -0,0 +1,273 @@
+package containers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	lxdclient "github.com/lxc/lxd/client"
+	"github.com/lxc/lxd/shared/api"
+)
+
+// TestShellQuote checks that a shell splits quoted arguments back into the
+// original arguments.
+func TestShellQuote(t *testing.T) {
+	args := []string{
+		"plain",
+		"with space",
+		`node-role.kubernetes.io/master=""`,
+		"it's",
+		"$HOME",
+		"a;b|c&&d",
+		"",
+	}
+
+	out, err := exec.Command("sh", "-c", "printf '%s\\n' "+ShellQuote(args...)).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	if len(got) != len(args) {
+		t.Fatalf("expected %d arguments, got %d: %q", len(args), len(got), got)
+	}
+	for i := range args {
+		if got[i] != args[i] {
+			t.Errorf("argument %d: expected %q, got %q", i, args[i], got[i])
+		}
+	}
+}
+
+func TestShellCommand(t *testing.T) {
+	argv := ShellCommand("echo a | tr a b")
+	out, err := exec.Command(argv[0], argv[1:]...).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "b\n" {
+		t.Errorf("expected %q, got %q", "b\n", out)
+	}
+}
+
+func TestExecErrorMessage(t *testing.T) {
+	tests := []struct {
+		err  ExecError
+		want string
+	}{
+		{
+			ExecError{Container: "c", Command: []string{"sleep", "9"}, TimedOut: true},
+			`command "sleep 9" in c timed out`,
+		},
+		{
+			ExecError{Container: "c", Command: []string{"false"}, Result: ExecResult{ExitCode: 1}},
+			`command "false" in c exited with status 1`,
+		},
+		{
+			ExecError{Container: "c", Command: []string{"ls"}, Result: ExecResult{Stdout: "out\n", Stderr: " err\n", ExitCode: 2}},
+			`command "ls" in c exited with status 2: err`,
+		},
+		{
+			ExecError{Container: "c", Command: []string{"ls"}, Result: ExecResult{Stdout: "out\n", ExitCode: 2}},
+			`command "ls" in c exited with status 2: out`,
+		},
+	}
+
+	for _, tt := range tests {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("expected %q, got %q", tt.want, got)
+		}
+	}
+}
+
+// fakeExecServer runs commands by calling exec instead of talking to LXD.
+// Their operations are cancelled by calling cancel, if it is set.
+type fakeExecServer struct {
+	lxdclient.InstanceServer
+	exec   func(args *lxdclient.InstanceExecArgs, op *fakeOperation)
+	cancel func(op *fakeOperation) error
+}
+
+func (s *fakeExecServer) ExecInstance(name string, req api.InstanceExecPost, args *lxdclient.InstanceExecArgs) (lxdclient.Operation, error) {
+	op := &fakeOperation{args: args, done: make(chan struct{})}
+	if s.cancel != nil {
+		op.cancel = func() error { return s.cancel(op) }
+	}
+	go s.exec(args, op)
+	return op, nil
+}
+
+// fakeOperation is an exec operation that ends when finish is called.
+type fakeOperation struct {
+	lxdclient.Operation
+	args   *lxdclient.InstanceExecArgs
+	done   chan struct{}
+	code   int
+	err    error
+	cancel func() error
+}
+
+func (o *fakeOperation) finish(code int, err error) {
+	o.code = code
+	o.err = err
+	close(o.args.DataDone)
+	close(o.done)
+}
+
+// cancelOperation ends a fake operation as LXD does when it is cancelled.
+func cancelOperation(op *fakeOperation) error {
+	go op.finish(-1, errors.New("operation cancelled"))
+	return nil
+}
+
+func (o *fakeOperation) Wait() error {
+	<-o.done
+	return o.err
+}
+
+func (o *fakeOperation) Cancel() error {
+	if o.cancel == nil {
+		return errors.New("operation can't be cancelled")
+	}
+	return o.cancel()
+}
+
+func (o *fakeOperation) Get() api.Operation {
+	return api.Operation{Metadata: map[string]interface{}{"return": float64(o.code)}}
+}
+
+func TestExecContextExitCode(t *testing.T) {
+	is := &fakeExecServer{exec: func(args *lxdclient.InstanceExecArgs, op *fakeOperation) {
+		io.WriteString(args.Stdout, "out\n")
+		io.WriteString(args.Stderr, "boom\n")
+		op.finish(3, nil)
+	}}
+
+	result, err := ExecContext(context.Background(), "c", ExecOptions{Command: []string{"false"}}, is)
+	var execErr *ExecError
+	if !errors.As(err, &execErr) {
+		t.Fatalf("expected an *ExecError, got %v", err)
+	}
+	if execErr.TimedOut {
+		t.Error("expected the command not to time out")
+	}
+	if result.ExitCode != 3 || execErr.Result.ExitCode != 3 {
+		t.Errorf("expected exit status 3, got %d and %d", result.ExitCode, execErr.Result.ExitCode)
+	}
+	if result.Stdout != "out\n" || result.Stderr != "boom\n" {
+		t.Errorf("unexpected output %+v", result)
+	}
+}
+
+func TestExecContextSuccess(t *testing.T) {
+	is := &fakeExecServer{exec: func(args *lxdclient.InstanceExecArgs, op *fakeOperation) {
+		io.WriteString(args.Stdout, "ok\n")
+		op.finish(0, nil)
+	}}
+
+	result, err := ExecContext(context.Background(), "c", ExecOptions{Command: []string{"true"}}, is)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Stdout != "ok\n" {
+		t.Errorf("expected %q, got %q", "ok\n", result.Stdout)
+	}
+}
+
+// TestExecContextTimeoutSignals checks that a command that times out is
+// killed through the control websocket.
+func TestExecContextTimeoutSignals(t *testing.T) {
+	signals := make(chan int, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var msg api.InstanceExecControl
+		if err := conn.ReadJSON(&msg); err == nil && msg.Command == "signal" {
+			signals <- msg.Signal
+		}
+	}))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	is := &fakeExecServer{exec: func(args *lxdclient.InstanceExecArgs, op *fakeOperation) {
+		go args.Control(conn)
+		op.finish(128+<-signals, nil)
+	}}
+
+	_, err = ExecContext(context.Background(), "c", ExecOptions{Command: []string{"sleep", "9"}, Timeout: 100 * time.Millisecond}, is)
+	var execErr *ExecError
+	if !errors.As(err, &execErr) || !execErr.TimedOut {
+		t.Fatalf("expected a timed out *ExecError, got %v", err)
+	}
+	if execErr.Result.ExitCode != 128+int(syscall.SIGKILL) {
+		t.Errorf("expected the command to be killed, got exit status %d", execErr.Result.ExitCode)
+	}
+}
+
+// TestExecContextTimeoutCancels checks that a command whose control
+// websocket isn't connected is stopped by cancelling its operation.
+func TestExecContextTimeoutCancels(t *testing.T) {
+	is := &fakeExecServer{
+		exec:   func(args *lxdclient.InstanceExecArgs, op *fakeOperation) {},
+		cancel: cancelOperation,
+	}
+
+	_, err := ExecContext(context.Background(), "c", ExecOptions{Command: []string{"sleep", "9"}, Timeout: 50 * time.Millisecond}, is)
+	var execErr *ExecError
+	if !errors.As(err, &execErr) || !execErr.TimedOut {
+		t.Fatalf("expected a timed out *ExecError, got %v", err)
+	}
+}
+
+// TestExecContextTimeoutAbandons checks that a command that can be neither
+// signalled nor cancelled doesn't block its caller.
+func TestExecContextTimeoutAbandons(t *testing.T) {
+	is := &fakeExecServer{exec: func(args *lxdclient.InstanceExecArgs, op *fakeOperation) {}}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := ExecContext(context.Background(), "c", ExecOptions{Command: []string{"sleep", "9"}, Timeout: 50 * time.Millisecond}, is)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		var execErr *ExecError
+		if !errors.As(err, &execErr) || !execErr.TimedOut {
+			t.Fatalf("expected a timed out *ExecError, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ExecContext did not return after its timeout")
+	}
+}
+
+func TestExecContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	is := &fakeExecServer{
+		exec: func(args *lxdclient.InstanceExecArgs, op *fakeOperation) {
+			cancel()
+		},
+		cancel: cancelOperation,
+	}
+
+	_, err := ExecContext(ctx, "c", ExecOptions{Command: []string{"sleep", "9"}}, is)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
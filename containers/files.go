@@ -0,0 +1,150 @@
+package containers
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	lxdclient "github.com/lxc/lxd/client"
+)
+
+// PullTree copies src in container to dst on the local filesystem, recursing
+// into directories. Modes are kept; owners are kept only when running as
+// root, since nobody else can give files away.
+func PullTree(container, src, dst string, is lxdclient.InstanceServer) error {
+	content, resp, err := is.GetInstanceFile(container, src)
+	if err != nil {
+		return fmt.Errorf("cannot pull %s from %s: %w", src, container, err)
+	}
+	// directories come back as a list of entries with no content
+	if content != nil {
+		defer content.Close()
+	}
+
+	mode := os.FileMode(resp.Mode).Perm()
+	switch resp.Type {
+	case "directory":
+		// write into the directory before it gets a possibly read-only mode
+		if err := os.MkdirAll(dst, 0700); err != nil {
+			return fmt.Errorf("cannot mkdir %s: %w", dst, err)
+		}
+		for _, entry := range resp.Entries {
+			if err := PullTree(container, path.Join(src, entry), path.Join(dst, entry), is); err != nil {
+				return err
+			}
+		}
+		if err := os.Chmod(dst, mode); err != nil {
+			return err
+		}
+	case "file":
+		f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return fmt.Errorf("cannot create %s: %w", dst, err)
+		}
+		if _, err := io.Copy(f, content); err != nil {
+			f.Close()
+			return fmt.Errorf("cannot pull %s from %s: %w", src, container, err)
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		// the mode given to OpenFile is masked by the umask
+		if err := os.Chmod(dst, mode); err != nil {
+			return err
+		}
+	case "symlink":
+		target, err := io.ReadAll(content)
+		if err != nil {
+			return fmt.Errorf("cannot pull %s from %s: %w", src, container, err)
+		}
+		os.Remove(dst)
+		if err := os.Symlink(strings.TrimSpace(string(target)), dst); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%s in %s has unsupported type %s", src, container, resp.Type)
+	}
+
+	if os.Geteuid() == 0 {
+		return os.Lchown(dst, int(resp.UID), int(resp.GID))
+	}
+
+	return nil
+}
+
+// PushTree copies src on the local filesystem to dst in container, recursing
+// into directories and keeping modes and owners.
+func PushTree(src, container, dst string, is lxdclient.InstanceServer) error {
+	stat, err := os.Lstat(src)
+	if err != nil {
+		return fmt.Errorf("cannot stat %s: %w", src, err)
+	}
+
+	args := lxdclient.InstanceFileArgs{
+		Mode:      int(stat.Mode().Perm()),
+		WriteMode: "overwrite",
+	}
+	if linuxstat, ok := stat.Sys().(*syscall.Stat_t); ok {
+		args.UID = int64(linuxstat.Uid)
+		args.GID = int64(linuxstat.Gid)
+	}
+
+	switch {
+	case stat.IsDir():
+		args.Type = "directory"
+		if err := is.CreateInstanceFile(container, dst, args); err != nil {
+			return fmt.Errorf("cannot mkdir %s in %s: %w", dst, container, err)
+		}
+
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := PushTree(path.Join(src, entry.Name()), container, path.Join(dst, entry.Name()), is); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case stat.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		args.Type = "symlink"
+		args.Content = strings.NewReader(target)
+	case stat.Mode().IsRegular():
+		f, err := os.Open(src)
+		if err != nil {
+			return fmt.Errorf("cannot read %s: %w", src, err)
+		}
+		defer f.Close()
+		args.Type = "file"
+		args.Content = f
+	default:
+		return fmt.Errorf("%s is not a file, directory or symlink", src)
+	}
+
+	if err := is.CreateInstanceFile(container, dst, args); err != nil {
+		return fmt.Errorf("cannot push %s to %s: %w", dst, container, err)
+	}
+
+	return nil
+}
+
+// IsDir returns true if p exists in container and is a directory.
+func IsDir(container, p string, is lxdclient.InstanceServer) bool {
+	content, resp, err := is.GetInstanceFile(container, p)
+	if err != nil {
+		return false
+	}
+	if content != nil {
+		content.Close()
+	}
+
+	return resp.Type == "directory"
+}
@@ -0,0 +1,110 @@
+package containers
+
+import (
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+
+	lxdclient "github.com/lxc/lxd/client"
+	"github.com/lxc/lxd/shared/api"
+)
+
+// mountDevicePrefix prefixes the names of the disk devices AddDiskMount
+// creates, so they can't collide with devices from profiles.
+const mountDevicePrefix = "lxdk-mount"
+
+// MountDeviceName returns the name of the disk device that mounts a host
+// directory at path inside a container.
+func MountDeviceName(path string) string {
+	name := strings.Trim(path, "/")
+	if name == "" {
+		return mountDevicePrefix + "-root"
+	}
+
+	return mountDevicePrefix + "-" + strings.ReplaceAll(name, "/", "-")
+}
+
+// removeMountDevices deletes the disk devices mounting host directories from
+// devices.
+func removeMountDevices(devices map[string]map[string]string) {
+	for name := range devices {
+		if strings.HasPrefix(name, mountDevicePrefix+"-") {
+			delete(devices, name)
+		}
+	}
+}
+
+// AddDiskMount mounts the host directory source at path inside container,
+// replacing any other mount already at path. Unprivileged containers get the
+// mount idmapped with shift=true when the LXD server supports it, so files
+// keep their host owners inside the container; without support they show
+// up owned by nobody.
+func AddDiskMount(container, source, path string, readOnly bool, is lxdclient.InstanceServer) error {
+	in, etag, err := is.GetInstance(container)
+	if err != nil {
+		return fmt.Errorf("could not get %s: %w", container, err)
+	}
+
+	device := map[string]string{
+		"type":   "disk",
+		"source": source,
+		"path":   path,
+	}
+	if readOnly {
+		device["readonly"] = "true"
+	}
+
+	if in.ExpandedConfig["security.privileged"] != "true" {
+		shift, err := supportsShift(is)
+		if err != nil {
+			return err
+		}
+		if shift {
+			device["shift"] = "true"
+		} else {
+			log.Default().Printf("LXD server can't shift mounts, files in %s on %s will be owned by nobody", path, container)
+		}
+	}
+
+	if in.Devices == nil {
+		in.Devices = make(map[string]map[string]string)
+	}
+	if reflect.DeepEqual(in.Devices[MountDeviceName(path)], device) {
+		return nil
+	}
+	in.Devices[MountDeviceName(path)] = device
+
+	return updateInstance(container, in.Writable(), etag, is)
+}
+
+// RemoveDiskMount removes the mount AddDiskMount created at path inside
+// container. A mount that doesn't exist is not an error.
+func RemoveDiskMount(container, path string, is lxdclient.InstanceServer) error {
+	return RemoveDevice(container, MountDeviceName(path), is)
+}
+
+func updateInstance(container string, put api.InstancePut, etag string, is lxdclient.InstanceServer) error {
+	op, err := is.UpdateInstance(container, put, etag)
+	if err != nil {
+		return fmt.Errorf("could not update %s: %w", container, err)
+	}
+
+	if err := op.Wait(); err != nil {
+		return fmt.Errorf("could not update %s: %w", container, err)
+	}
+
+	return nil
+}
+
+// supportsShift returns true if the LXD server can idmap disk devices,
+// either with idmapped mounts or shiftfs.
+func supportsShift(is lxdclient.InstanceServer) (bool, error) {
+	server, _, err := is.GetServer()
+	if err != nil {
+		return false, fmt.Errorf("could not get LXD server info: %w", err)
+	}
+
+	features := server.Environment.KernelFeatures
+	return features["idmapped_mounts"] == "true" || features["shiftfs"] == "true", nil
+}
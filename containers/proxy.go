@@ -0,0 +1,56 @@
+package containers
+
+import (
+	"fmt"
+	"strconv"
+
+	lxdclient "github.com/lxc/lxd/client"
+)
+
+// APIProxyDevice is the name of the proxy device publishing the Kubernetes
+// API server of a controller on the LXD host.
+const APIProxyDevice = "lxdk-api"
+
+// NodePortProxyDevice returns the name of the proxy device publishing
+// nodePort of a worker on the LXD host.
+func NodePortProxyDevice(nodePort int) string {
+	return "lxdk-nodeport-" + strconv.Itoa(nodePort)
+}
+
+// AddProxyDevice adds a proxy device named name to container, forwarding
+// TCP connections to listenAddress:listenPort on the LXD host to
+// 127.0.0.1:port inside container. A device already named name is
+// replaced.
+func AddProxyDevice(container, name, listenAddress string, listenPort, port int, is lxdclient.InstanceServer) error {
+	in, etag, err := is.GetInstance(container)
+	if err != nil {
+		return fmt.Errorf("could not get %s: %w", container, err)
+	}
+
+	if in.Devices == nil {
+		in.Devices = make(map[string]map[string]string)
+	}
+	in.Devices[name] = map[string]string{
+		"type":    "proxy",
+		"listen":  fmt.Sprintf("tcp:%s:%d", listenAddress, listenPort),
+		"connect": fmt.Sprintf("tcp:127.0.0.1:%d", port),
+	}
+
+	return updateInstance(container, in.Writable(), etag, is)
+}
+
+// RemoveDevice removes the device named name from container. A device that
+// doesn't exist is not an error.
+func RemoveDevice(container, name string, is lxdclient.InstanceServer) error {
+	in, etag, err := is.GetInstance(container)
+	if err != nil {
+		return fmt.Errorf("could not get %s: %w", container, err)
+	}
+
+	if _, ok := in.Devices[name]; !ok {
+		return nil
+	}
+	delete(in.Devices, name)
+
+	return updateInstance(container, in.Writable(), etag, is)
+}
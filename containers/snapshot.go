@@ -0,0 +1,95 @@
+package containers
+
+import (
+	"fmt"
+	"net/http"
+
+	lxdclient "github.com/lxc/lxd/client"
+	"github.com/lxc/lxd/shared/api"
+)
+
+// CreateSnapshot takes a snapshot of container's filesystem named name.
+func CreateSnapshot(container, name string, is lxdclient.InstanceServer) error {
+	op, err := is.CreateInstanceSnapshot(container, api.InstanceSnapshotsPost{Name: name})
+	if err != nil {
+		return fmt.Errorf("could not snapshot %s: %w", container, err)
+	}
+
+	if err := op.Wait(); err != nil {
+		return fmt.Errorf("could not snapshot %s: %w", container, err)
+	}
+
+	return nil
+}
+
+// RestoreSnapshot rolls container back to its snapshot named name.
+func RestoreSnapshot(container, name string, is lxdclient.InstanceServer) error {
+	op, err := is.UpdateInstance(container, api.InstancePut{Restore: name}, "")
+	if err != nil {
+		return fmt.Errorf("could not restore %s to %s: %w", container, name, err)
+	}
+
+	if err := op.Wait(); err != nil {
+		return fmt.Errorf("could not restore %s to %s: %w", container, name, err)
+	}
+
+	return nil
+}
+
+// DeleteSnapshot deletes container's snapshot named name. A snapshot that
+// doesn't exist is not an error.
+func DeleteSnapshot(container, name string, is lxdclient.InstanceServer) error {
+	op, err := is.DeleteInstanceSnapshot(container, name)
+	if err != nil {
+		if api.StatusErrorCheck(err, http.StatusNotFound) {
+			return nil
+		}
+		return fmt.Errorf("could not delete snapshot %s of %s: %w", name, container, err)
+	}
+
+	if err := op.Wait(); err != nil {
+		return fmt.Errorf("could not delete snapshot %s of %s: %w", name, container, err)
+	}
+
+	return nil
+}
+
+// HasSnapshot returns true if container has a snapshot named name.
+func HasSnapshot(container, name string, is lxdclient.InstanceServer) (bool, error) {
+	_, _, err := is.GetInstanceSnapshot(container, name)
+	if err != nil {
+		if api.StatusErrorCheck(err, http.StatusNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// FreezeContainer pauses every process in container, leaving its filesystem
+// in a consistent state until UnfreezeContainer is called.
+func FreezeContainer(container string, is lxdclient.InstanceServer) error {
+	return changeState(container, "freeze", is)
+}
+
+// UnfreezeContainer resumes a container paused by FreezeContainer.
+func UnfreezeContainer(container string, is lxdclient.InstanceServer) error {
+	return changeState(container, "unfreeze", is)
+}
+
+func changeState(container, action string, is lxdclient.InstanceServer) error {
+	op, err := is.UpdateInstanceState(container, api.InstanceStatePut{
+		Action:  action,
+		Timeout: -1,
+	}, "")
+	if err != nil {
+		return fmt.Errorf("could not %s %s: %w", action, container, err)
+	}
+
+	if err := op.Wait(); err != nil {
+		return fmt.Errorf("could not %s %s: %w", action, container, err)
+	}
+
+	return nil
+}
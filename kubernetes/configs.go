@@ -1,6 +1,10 @@
 package kubernetes
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/greymatter-io/lxdk/containers"
+)
 
 // TODO: templating engine text/template
 func WorkerRegistriesConfig(registryName, registryIP string) []byte {
@@ -21,7 +25,16 @@ location = "%s:-127.0.0.1}:5000"`, registryName, registryName, registryName, reg
 
 // this one could be removed by not putting the unique container ID for the
 // kubelet in the name of the cert in the container itslef
-func KubeletConfig(containerName string) []byte {
+func KubeletConfig(containerName string, unprivileged bool) []byte {
+	// the kubelet ignores the errors it gets setting up the node
+	// unprivileged, such as writing kernel tunables
+	var featureGates string
+	if unprivileged {
+		featureGates = `
+featureGates:
+  KubeletInUserNamespace: true`
+	}
+
 	return []byte(fmt.Sprintf(`kind: KubeletConfiguration
 apiVersion: kubelet.config.k8s.io/v1beta1
 authentication:
@@ -49,7 +62,24 @@ maxPods: 1000
 # https://github.com/kubernetes/kubernetes/issues/66067
 # https://github.com/kubernetes-sigs/cri-o/issues/1769
 #resolverConfig: /run/systemd/resolve/resolv.conf
-#resolverConfig: /var/run/netconfig/resolv.conf`, containerName, containerName))
+#resolverConfig: /var/run/netconfig/resolv.conf%s`, containerName, containerName, featureGates))
+}
+
+// CRIOCgroupConfig returns a CRI-O drop-in matching the kubelet's cgroup
+// settings for cgroupMode. Both hierarchies are managed by systemd inside the
+// nodes, so both use the systemd driver. With the unified hierarchy conmon has
+// to be placed in the pod's cgroup, as systemd won't delegate system.slice to
+// it.
+func CRIOCgroupConfig(cgroupMode string) []byte {
+	conmonCgroup := "system.slice"
+	if cgroupMode == containers.CgroupV2 {
+		conmonCgroup = "pod"
+	}
+
+	return []byte(fmt.Sprintf(`[crio.runtime]
+cgroup_manager = "systemd"
+conmon_cgroup = "%s"
+`, conmonCgroup))
 }
 
 func KubeletUnitConfig(containerName string) []byte {
@@ -71,3 +101,10 @@ RestartSec=5
 [Install]
 WantedBy=multi-user.target`, containerName))
 }
+
+// KmsgTmpfilesConfig returns a tmpfiles.d entry linking /dev/kmsg, which the
+// kubelet reads, to /dev/console. /dev is a tmpfs in LXD containers, so the
+// link is lost whenever a node restarts and has to be made again on boot.
+func KmsgTmpfilesConfig() []byte {
+	return []byte("L+ /dev/kmsg - - - - /dev/console\n")
+}
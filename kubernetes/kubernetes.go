@@ -7,38 +7,83 @@ import (
 	"strings"
 	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	rbac "k8s.io/client-go/applyconfigurations/rbac/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
 )
 
-func WaitAPIServerReady(clientset kubernetes.Clientset) error {
-	_, err := clientset.RbacV1().ClusterRoles().List(context.Background(), v1.ListOptions{})
-	for c := 0; c < 50 && err != nil; c++ {
+// WaitAPIServerReady polls until the API server answers requests, giving up
+// when ctx is done.
+func WaitAPIServerReady(ctx context.Context, clientset kubernetes.Clientset) error {
+	_, err := clientset.RbacV1().ClusterRoles().List(ctx, v1.ListOptions{})
+	for err != nil {
 		log.Default().Println("waiting for API server...", err.Error())
-		time.Sleep(3 * time.Second)
-		_, err = clientset.RbacV1().ClusterRoles().List(context.Background(), v1.ListOptions{})
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("API server did not become ready: %w", ctx.Err())
+		case <-time.After(3 * time.Second):
+		}
+		_, err = clientset.RbacV1().ClusterRoles().List(ctx, v1.ListOptions{})
 	}
 
-	return err
+	return nil
+}
+
+// WaitNode polls until the node name has registered, giving up when ctx is
+// done.
+func WaitNode(ctx context.Context, clientset kubernetes.Clientset, name string) error {
+	_, err := clientset.CoreV1().Nodes().Get(ctx, name, v1.GetOptions{})
+	for err != nil {
+		log.Default().Printf("waiting for node: %s: %s", name, err.Error())
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("node %s did not register: %w", name, ctx.Err())
+		case <-time.After(3 * time.Second):
+		}
+		_, err = clientset.CoreV1().Nodes().Get(ctx, name, v1.GetOptions{})
+	}
+
+	return nil
 }
 
-func WaitNode(clientset kubernetes.Clientset, name string) error {
-	_, err := clientset.CoreV1().Nodes().Get(context.Background(), name, v1.GetOptions{})
-	for c := 0; c < 50 && err != nil; c++ {
-		if strings.Contains(err.Error(), "not found") {
+// WaitNodeReady polls until the node name reports it is ready, giving up when
+// ctx is done.
+func WaitNodeReady(ctx context.Context, clientset kubernetes.Clientset, name string) error {
+	for {
+		node, err := clientset.CoreV1().Nodes().Get(ctx, name, v1.GetOptions{})
+		if err == nil && nodeReady(node) {
 			return nil
 		}
+		if err == nil {
+			err = fmt.Errorf("not ready")
+		}
+
 		log.Default().Printf("waiting for node: %s: %s", name, err.Error())
-		time.Sleep(3 * time.Second)
-		_, err = clientset.RbacV1().ClusterRoles().Get(context.Background(), "", v1.GetOptions{})
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("node %s did not become ready: %w", name, ctx.Err())
+		case <-time.After(3 * time.Second):
+		}
 	}
+}
 
-	return err
+func nodeReady(node *corev1.Node) bool {
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == corev1.NodeReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+
+	return false
 }
 
-func ConfigureRBAC(clientset kubernetes.Clientset) error {
+// ConfigureRBAC lets the API server reach the kubelets, giving up when ctx is
+// done.
+func ConfigureRBAC(ctx context.Context, clientset kubernetes.Clientset) error {
 	apiVersion := "rbac.authorization.k8s.io/v1"
 
 	apiToKubelet := rbac.ClusterRole("system:kube-apiserver-to-kubelet")
@@ -63,7 +108,7 @@ func ConfigureRBAC(clientset kubernetes.Clientset) error {
 		},
 	}
 
-	_, err := clientset.RbacV1().ClusterRoles().Apply(context.Background(), apiToKubelet, v1.ApplyOptions{
+	_, err := clientset.RbacV1().ClusterRoles().Apply(ctx, apiToKubelet, v1.ApplyOptions{
 		FieldManager: "application/apply-patch",
 	})
 	if err != nil {
@@ -97,7 +142,7 @@ func ConfigureRBAC(clientset kubernetes.Clientset) error {
 		},
 	}
 
-	_, err = clientset.RbacV1().ClusterRoleBindings().Apply(context.Background(), kubeAPIServer, v1.ApplyOptions{
+	_, err = clientset.RbacV1().ClusterRoleBindings().Apply(ctx, kubeAPIServer, v1.ApplyOptions{
 		FieldManager: "application/apply-patch",
 	})
 	if err != nil {
@@ -107,6 +152,143 @@ func ConfigureRBAC(clientset kubernetes.Clientset) error {
 	return nil
 }
 
+// ServerVersion returns the git version of the API server, e.g. v1.23.1.
+func ServerVersion(clientset kubernetes.Clientset) (string, error) {
+	info, err := clientset.Discovery().ServerVersion()
+	if err != nil {
+		return "", fmt.Errorf("could not get server version: %w", err)
+	}
+
+	return info.GitVersion, nil
+}
+
+// ComponentVersions returns the versions of the node components reported by
+// the named node.
+func ComponentVersions(ctx context.Context, clientset kubernetes.Clientset, name string) (map[string]string, error) {
+	node, err := clientset.CoreV1().Nodes().Get(ctx, name, v1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not get node %s: %w", name, err)
+	}
+
+	info := node.Status.NodeInfo
+	return map[string]string{
+		"kubelet":           info.KubeletVersion,
+		"kube-proxy":        info.KubeProxyVersion,
+		"container-runtime": info.ContainerRuntimeVersion,
+		"kernel":            info.KernelVersion,
+	}, nil
+}
+
+// ReplaceNode moves the labels and taints of the node oldName onto newName,
+// waiting for newName to register until ctx is done, and deletes oldName. It
+// is used when a node's container has been copied and the copy registered
+// under a new name.
+func ReplaceNode(ctx context.Context, clientset kubernetes.Clientset, oldName, newName string) error {
+	nodes := clientset.CoreV1().Nodes()
+
+	old, err := nodes.Get(ctx, oldName, v1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not get node %s: %w", oldName, err)
+	}
+
+	if err := WaitNode(ctx, clientset, newName); err != nil {
+		return err
+	}
+	node, err := nodes.Get(ctx, newName, v1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("could not get node %s: %w", newName, err)
+	}
+
+	if node.Labels == nil {
+		node.Labels = make(map[string]string)
+	}
+	for key, value := range old.Labels {
+		// these describe the node itself and are set by its kubelet
+		if key == "kubernetes.io/hostname" || strings.HasPrefix(key, "node.kubernetes.io/") {
+			continue
+		}
+		if _, ok := node.Labels[key]; !ok {
+			node.Labels[key] = value
+		}
+	}
+	for _, taint := range old.Spec.Taints {
+		if strings.HasPrefix(taint.Key, "node.kubernetes.io/") || hasTaint(node.Spec.Taints, taint.Key) {
+			continue
+		}
+		node.Spec.Taints = append(node.Spec.Taints, taint)
+	}
+
+	if _, err := nodes.Update(ctx, node, v1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("could not update node %s: %w", newName, err)
+	}
+
+	err = nodes.Delete(ctx, oldName, v1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("could not delete node %s: %w", oldName, err)
+	}
+
+	return nil
+}
+
+// MarkController labels the node name as the controller, which ingress-nginx
+// is scheduled on, and taints it so that other pods aren't.
+func MarkController(ctx context.Context, clientset kubernetes.Clientset, name string) error {
+	nodes := clientset.CoreV1().Nodes()
+
+	// the kubelet updates its node too, so the update is retried on
+	// conflicts
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		node, err := nodes.Get(ctx, name, v1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		markController(node)
+		_, err = nodes.Update(ctx, node, v1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not label and taint node %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// markController sets the labels and taint of a controller node on node,
+// replacing any taint with the same key and effect.
+func markController(node *corev1.Node) {
+	if node.Labels == nil {
+		node.Labels = make(map[string]string)
+	}
+	node.Labels["node-role.kubernetes.io/master"] = ""
+	node.Labels["ingress-nginx"] = ""
+
+	taint := corev1.Taint{
+		Key:    "node-role.kubernetes.io/master",
+		Effect: corev1.TaintEffectNoSchedule,
+	}
+	for i, t := range node.Spec.Taints {
+		if t.Key == taint.Key && t.Effect == taint.Effect {
+			node.Spec.Taints[i] = taint
+			return
+		}
+	}
+	node.Spec.Taints = append(node.Spec.Taints, taint)
+}
+
+func hasTaint(taints []corev1.Taint, key string) bool {
+	for _, taint := range taints {
+		if taint.Key == key {
+			return true
+		}
+	}
+
+	return false
+}
+
 func GetClientset(filename string) (*kubernetes.Clientset, error) {
 	adminKfg, err := clientcmd.BuildConfigFromFlags("", filename)
 	if err != nil {
@@ -0,0 +1,29 @@
+package kubernetes
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// TestMarkController checks that marking a node twice leaves a single taint,
+// as kubectl taint --overwrite would.
+func TestMarkController(t *testing.T) {
+	node := &corev1.Node{}
+	node.Spec.Taints = []corev1.Taint{{Key: "node.kubernetes.io/not-ready", Effect: corev1.TaintEffectNoSchedule}}
+
+	markController(node)
+	markController(node)
+
+	for _, label := range []string{"node-role.kubernetes.io/master", "ingress-nginx"} {
+		if value, ok := node.Labels[label]; !ok || value != "" {
+			t.Errorf("expected label %s to be set to \"\", got %q", label, value)
+		}
+	}
+	if len(node.Spec.Taints) != 2 {
+		t.Fatalf("expected 2 taints, got %+v", node.Spec.Taints)
+	}
+	if !hasTaint(node.Spec.Taints, "node-role.kubernetes.io/master") {
+		t.Errorf("controller taint was not added: %+v", node.Spec.Taints)
+	}
+}
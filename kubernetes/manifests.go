@@ -1,6 +1,7 @@
 package kubernetes
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os/exec"
@@ -431,10 +432,12 @@ spec:
     protocol: TCP`)
 }
 
-func DeployManifest(clusterDir string, data []byte) error {
+// DeployManifest applies the manifest data with kubectl, killing kubectl if
+// ctx is done before it finishes.
+func DeployManifest(ctx context.Context, clusterDir string, data []byte) error {
 	kfg := path.Join(clusterDir, "kubeconfigs", "client.kubeconfig")
 
-	cmd := exec.Command("kubectl", "apply", "--kubeconfig", kfg, "-f", "-")
+	cmd := exec.CommandContext(ctx, "kubectl", "apply", "--kubeconfig", kfg, "-f", "-")
 
 	pipe, err := cmd.StdinPipe()
 	if err != nil {
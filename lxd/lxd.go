@@ -16,50 +16,113 @@ import (
 
 const snapSocketPath = "/var/snap/lxd/common/lxd/unix.socket"
 
+// ConnectOptions selects the LXD server and project to connect to. Empty
+// fields fall back on the lxc client configuration: its default config file,
+// its default remote and the default project.
+type ConnectOptions struct {
+	// ConfigPath is the path to the lxc config.yml
+	ConfigPath string
+	// Remote is the name of an lxc remote
+	Remote  string
+	Project string
+}
+
+// InstanceServerConnect connects to the default project of the default remote
+// of the lxc client.
 func InstanceServerConnect() (lxd.InstanceServer, string, error) {
+	return Connect(ConnectOptions{})
+}
+
+// Connect connects to the remote and project selected by opts. It returns the
+// instance server and the hostname of the remote, which is empty for local
+// servers.
+func Connect(opts ConnectOptions) (lxd.InstanceServer, string, error) {
 	var is lxd.InstanceServer
-	confDir := path.Join(os.Getenv("HOME"), ".config", "lxc")
 
 	isSnap, err := IsSnap()
 	if err != nil {
 		return nil, "", err
 	}
-	if isSnap {
-		confDir = path.Join(os.Getenv("HOME"), "snap", "lxd", "common", "config")
-	}
 
-	lxdConf := os.Getenv("LXD_CONF")
-	if !(lxdConf == "") {
-		confDir = lxdConf
-	}
-
-	confFile := path.Join(confDir, "config.yml")
-
-	conf, err := config.LoadConfig(confFile)
+	conf, err := loadConfig(opts.ConfigPath, isSnap)
 	if err != nil {
 		return is, "", err
 	}
 
-	if isSnap && conf.DefaultRemote == "local" {
+	remote := opts.Remote
+	if remote == "" {
+		remote = conf.DefaultRemote
+	}
+	if _, ok := conf.Remotes[remote]; !ok {
+		return nil, "", errors.Errorf("lxc remote %s does not exist", remote)
+	}
+
+	if isSnap && remote == "local" {
 		is, err = lxd.ConnectLXDUnix(snapSocketPath, nil)
 		if err != nil {
 			return lxd.InstanceServer(is), "", errors.Errorf("could not connect to socket at %s", snapSocketPath)
 		}
-		return is, "", err
+		return useProject(is, opts.Project), "", err
 	}
 
-	log.Default().Printf("using remote: %s", conf.DefaultRemote)
-	is, err = conf.GetInstanceServer(conf.DefaultRemote)
+	log.Default().Printf("using remote: %s", remote)
+	is, err = conf.GetInstanceServer(remote)
 	if err != nil {
 		return nil, "", fmt.Errorf("error getting instance server from config: %w", err)
 	}
 
-	uri, err := url.Parse(conf.Remotes[conf.DefaultRemote].Addr)
+	uri, err := url.Parse(conf.Remotes[remote].Addr)
 	if err != nil {
 		return nil, "", err
 	}
 
-	return is, uri.Hostname(), nil
+	return useProject(is, opts.Project), uri.Hostname(), nil
+}
+
+// DefaultRemote returns the name of the default remote in the lxc config at
+// configPath, or the default config if configPath is empty.
+func DefaultRemote(configPath string) (string, error) {
+	isSnap, err := IsSnap()
+	if err != nil {
+		return "", err
+	}
+
+	conf, err := loadConfig(configPath, isSnap)
+	if err != nil {
+		return "", err
+	}
+
+	return conf.DefaultRemote, nil
+}
+
+func useProject(is lxd.InstanceServer, project string) lxd.InstanceServer {
+	if project == "" {
+		return is
+	}
+
+	log.Default().Printf("using project: %s", project)
+	return is.UseProject(project)
+}
+
+// loadConfig loads the lxc config at confFile. If confFile is empty the
+// config is looked up where lxc keeps it: $LXD_CONF, or the snap or regular
+// config directory.
+func loadConfig(confFile string, isSnap bool) (*config.Config, error) {
+	if confFile == "" {
+		confDir := path.Join(os.Getenv("HOME"), ".config", "lxc")
+		if isSnap {
+			confDir = path.Join(os.Getenv("HOME"), "snap", "lxd", "common", "config")
+		}
+
+		lxdConf := os.Getenv("LXD_CONF")
+		if !(lxdConf == "") {
+			confDir = lxdConf
+		}
+
+		confFile = path.Join(confDir, "config.yml")
+	}
+
+	return config.LoadConfig(confFile)
 }
 
 // IsSnap returns true if lxd was installed using snap, and false otherwise.